@@ -0,0 +1,381 @@
+package tunkit
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// AdmissionLimits are applied to a single source IP or to a network.
+// Zero disables a limit.
+type AdmissionLimits struct {
+	// MaxConns is the number of concurrent connections.
+	MaxConns int
+	// MaxHandshakes is the number of new connections per RateWindow.
+	MaxHandshakes int
+}
+
+type admissionEntry struct {
+	conns      int
+	handshakes []time.Time
+	failures   []time.Time
+	violations []time.Time
+}
+
+// AdmissionBan is a temporarily banned address or network.
+type AdmissionBan struct {
+	Addr   string
+	Until  time.Time
+	Reason string
+}
+
+// AdmissionStats is a snapshot for operators.
+type AdmissionStats struct {
+	// Conns are the concurrent connections per source IP.
+	Conns map[string]int
+	Bans  []AdmissionBan
+}
+
+// AdmissionControl limits connections per source IP and per network and
+// temporarily bans sources after repeated auth failures or limit violations,
+// fail2ban-style. Plug it into the server with WithAdmissionControl.
+type AdmissionControl struct {
+	PerIP   AdmissionLimits
+	PerCIDR AdmissionLimits
+	// Networks are grouped by these prefix lengths, defaults to /24 and /64.
+	CIDRBitsV4 int
+	CIDRBitsV6 int
+	// RateWindow for MaxHandshakes, defaults to 1m.
+	RateWindow time.Duration
+
+	// MaxAuthFailures failed authentication attempts and MaxViolations
+	// within BanWindow ban a source IP (or network for network limits) for
+	// BanDuration. Zero disables.
+	MaxAuthFailures int
+	MaxViolations   int
+	// BanWindow defaults to 10m, BanDuration to 15m.
+	BanWindow   time.Duration
+	BanDuration time.Duration
+
+	Logger *slog.Logger
+
+	mu      sync.Mutex
+	entries map[string]*admissionEntry
+	bans    map[string]AdmissionBan
+}
+
+func NewAdmissionControl(logger *slog.Logger) *AdmissionControl {
+	return &AdmissionControl{
+		PerIP:           AdmissionLimits{MaxConns: 20, MaxHandshakes: 30},
+		PerCIDR:         AdmissionLimits{MaxConns: 100, MaxHandshakes: 120},
+		MaxAuthFailures: 10,
+		MaxViolations:   5,
+		Logger:          logger,
+	}
+}
+
+func (ac *AdmissionControl) rateWindow() time.Duration {
+	if ac.RateWindow == 0 {
+		return time.Minute
+	}
+	return ac.RateWindow
+}
+
+func (ac *AdmissionControl) banWindow() time.Duration {
+	if ac.BanWindow == 0 {
+		return 10 * time.Minute
+	}
+	return ac.BanWindow
+}
+
+func (ac *AdmissionControl) banDuration() time.Duration {
+	if ac.BanDuration == 0 {
+		return 15 * time.Minute
+	}
+	return ac.BanDuration
+}
+
+func (ac *AdmissionControl) network(ip net.IP) string {
+	bits, size := ac.CIDRBitsV6, 128
+	if bits == 0 {
+		bits = 64
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		bits, size = ac.CIDRBitsV4, 32
+		if bits == 0 {
+			bits = 24
+		}
+	}
+	ipNet := &net.IPNet{IP: ip.Mask(net.CIDRMask(bits, size)), Mask: net.CIDRMask(bits, size)}
+	return ipNet.String()
+}
+
+func sourceIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+		return net.ParseIP(host)
+	}
+}
+
+func prune(times []time.Time, window time.Duration) []time.Time {
+	cutoff := time.Now().Add(-window)
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i += 1
+	}
+	return times[i:]
+}
+
+// entry must be called with ac.mu held.
+func (ac *AdmissionControl) entry(key string) *admissionEntry {
+	if ac.entries == nil {
+		ac.entries = map[string]*admissionEntry{}
+	}
+	e, ok := ac.entries[key]
+	if !ok {
+		e = &admissionEntry{}
+		ac.entries[key] = e
+	}
+	return e
+}
+
+// banned must be called with ac.mu held.
+func (ac *AdmissionControl) banned(key string) (AdmissionBan, bool) {
+	ban, ok := ac.bans[key]
+	if !ok {
+		return ban, false
+	}
+	if time.Now().After(ban.Until) {
+		delete(ac.bans, key)
+		return ban, false
+	}
+	return ban, true
+}
+
+// ban must be called with ac.mu held.
+func (ac *AdmissionControl) ban(key string, reason string) {
+	if ac.bans == nil {
+		ac.bans = map[string]AdmissionBan{}
+	}
+	ban := AdmissionBan{
+		Addr:   key,
+		Until:  time.Now().Add(ac.banDuration()),
+		Reason: reason,
+	}
+	ac.bans[key] = ban
+	ac.Logger.Info("banned address", "addr", key, "until", ban.Until, "reason", reason)
+}
+
+// violation must be called with ac.mu held.
+func (ac *AdmissionControl) violation(key string, e *admissionEntry, reason string) {
+	ac.Logger.Info("admission limit exceeded", "addr", key, "reason", reason)
+	if ac.MaxViolations == 0 {
+		return
+	}
+	e.violations = append(prune(e.violations, ac.banWindow()), time.Now())
+	if len(e.violations) >= ac.MaxViolations {
+		e.violations = nil
+		ac.ban(key, fmt.Sprintf("repeated violations: %s", reason))
+	}
+}
+
+// check must be called with ac.mu held.
+func (ac *AdmissionControl) check(key string, e *admissionEntry, limits AdmissionLimits) error {
+	if ban, ok := ac.banned(key); ok {
+		return fmt.Errorf("%s banned until %s: %s", key, ban.Until.Format(time.RFC3339), ban.Reason)
+	}
+
+	if limits.MaxConns > 0 && e.conns >= limits.MaxConns {
+		reason := fmt.Sprintf("more than %d concurrent connections", limits.MaxConns)
+		ac.violation(key, e, reason)
+		return errors.New(reason)
+	}
+
+	e.handshakes = prune(e.handshakes, ac.rateWindow())
+	if limits.MaxHandshakes > 0 && len(e.handshakes) >= limits.MaxHandshakes {
+		reason := fmt.Sprintf("more than %d connections per %s", limits.MaxHandshakes, ac.rateWindow())
+		ac.violation(key, e, reason)
+		return errors.New(reason)
+	}
+
+	return nil
+}
+
+// Admit reserves a connection for the source address or returns why it is
+// rejected. Call the returned func when the connection ends.
+func (ac *AdmissionControl) Admit(addr net.Addr) (func(), error) {
+	ip := sourceIP(addr)
+	if ip == nil {
+		return func() {}, nil
+	}
+	ipKey := ip.String()
+	netKey := ac.network(ip)
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	ipEntry := ac.entry(ipKey)
+	netEntry := ac.entry(netKey)
+	err := ac.check(ipKey, ipEntry, ac.PerIP)
+	if err != nil {
+		return nil, err
+	}
+	err = ac.check(netKey, netEntry, ac.PerCIDR)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, e := range []*admissionEntry{ipEntry, netEntry} {
+		e.conns += 1
+		e.handshakes = append(e.handshakes, now)
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ac.mu.Lock()
+			defer ac.mu.Unlock()
+			for _, key := range []string{ipKey, netKey} {
+				e := ac.entry(key)
+				e.conns -= 1
+				ac.cleanup(key, e)
+			}
+		})
+	}, nil
+}
+
+// cleanup must be called with ac.mu held.
+func (ac *AdmissionControl) cleanup(key string, e *admissionEntry) {
+	e.handshakes = prune(e.handshakes, ac.rateWindow())
+	e.failures = prune(e.failures, ac.banWindow())
+	e.violations = prune(e.violations, ac.banWindow())
+	if e.conns == 0 && len(e.handshakes) == 0 && len(e.failures) == 0 && len(e.violations) == 0 {
+		delete(ac.entries, key)
+	}
+}
+
+// AuthFailed records a failed authentication and bans the source after
+// MaxAuthFailures.
+func (ac *AdmissionControl) AuthFailed(addr net.Addr) {
+	ac.authFailed(addr, 1)
+}
+
+func (ac *AdmissionControl) authFailed(addr net.Addr, attempts int) {
+	ip := sourceIP(addr)
+	if ip == nil || attempts == 0 {
+		return
+	}
+	key := ip.String()
+	ac.Logger.Info("authentication failed", "addr", key, "attempts", attempts)
+	if ac.MaxAuthFailures == 0 {
+		return
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	e := ac.entry(key)
+	e.failures = prune(e.failures, ac.banWindow())
+	now := time.Now()
+	for i := 0; i < attempts; i += 1 {
+		e.failures = append(e.failures, now)
+	}
+	if len(e.failures) >= ac.MaxAuthFailures {
+		e.failures = nil
+		ac.ban(key, fmt.Sprintf("%d failed authentications", ac.MaxAuthFailures))
+	}
+}
+
+func (ac *AdmissionControl) Unban(addr string) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	delete(ac.bans, addr)
+}
+
+func (ac *AdmissionControl) Stats() AdmissionStats {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	stats := AdmissionStats{Conns: map[string]int{}}
+	for key, e := range ac.entries {
+		if e.conns > 0 && net.ParseIP(key) != nil {
+			stats.Conns[key] = e.conns
+		}
+	}
+	for key := range ac.bans {
+		if ban, ok := ac.banned(key); ok {
+			stats.Bans = append(stats.Bans, ban)
+		}
+	}
+	sort.Slice(stats.Bans, func(i, j int) bool {
+		return stats.Bans[i].Until.Before(stats.Bans[j].Until)
+	})
+	return stats
+}
+
+// WithAdmissionControl rejects connections over the limits before the SSH
+// handshake and counts the failed authentication attempts of connections
+// that never authenticate. Sources are the conn's remote address, so serve
+// it on a NewProxyProtocolListener behind a load balancer, otherwise every
+// client shares the load balancer's budget and gets banned with it.
+func WithAdmissionControl(ac *AdmissionControl) ssh.Option {
+	return func(serv *ssh.Server) error {
+		prev := serv.ConnCallback
+		serv.ConnCallback = func(ctx ssh.Context, conn net.Conn) net.Conn {
+			if prev != nil {
+				conn = prev(ctx, conn)
+				if conn == nil {
+					return nil
+				}
+			}
+
+			release, err := ac.Admit(conn.RemoteAddr())
+			if err != nil {
+				ac.Logger.Info(
+					"rejected connection",
+					"remoteAddr", conn.RemoteAddr().String(),
+					"err", err,
+				)
+				return nil
+			}
+			go func() {
+				<-ctx.Done()
+				release()
+			}()
+			return conn
+		}
+
+		prevFailed := serv.ConnectionFailedCallback
+		serv.ConnectionFailedCallback = func(conn net.Conn, err error) {
+			var authErr *gossh.ServerAuthError
+			if errors.As(err, &authErr) {
+				// the client's probe with the none method is not an attempt
+				attempts := 0
+				for _, err := range authErr.Errors {
+					if !errors.Is(err, gossh.ErrNoAuth) {
+						attempts += 1
+					}
+				}
+				ac.authFailed(conn.RemoteAddr(), attempts)
+			}
+			if prevFailed != nil {
+				prevFailed(conn, err)
+			}
+		}
+		return nil
+	}
+}
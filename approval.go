@@ -0,0 +1,218 @@
+package tunkit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+)
+
+var (
+	ErrApprovalDenied     = errors.New("approval denied")
+	ErrApprovalTimeout    = errors.New("approval timed out")
+	ErrNoApprovalTerminal = errors.New("no terminal attached to approve the action, connect with `ssh -t`")
+
+	DefaultApprovalTimeout = time.Minute
+)
+
+var keyCtrlC byte = 3
+
+type approvalRequest struct {
+	action string
+	answer chan bool
+	// closed when the requester stopped waiting for an answer
+	done chan struct{}
+}
+
+// approvalTerminal is the pty session of an SSH connection that approval
+// prompts are shown in.
+type approvalTerminal struct {
+	requests chan *approvalRequest
+	// closed when the session ends
+	done chan struct{}
+	// serializes prompts coming from concurrent http requests
+	mu sync.Mutex
+}
+
+type ctxApprovalKey struct{}
+
+func getApprovalCtx(ctx ssh.Context) (*approvalTerminal, error) {
+	term, ok := ctx.Value(ctxApprovalKey{}).(*approvalTerminal)
+	if term == nil || !ok {
+		return nil, ErrNoApprovalTerminal
+	}
+	return term, nil
+}
+func setApprovalCtx(ctx ssh.Context, term *approvalTerminal) {
+	ctx.SetValue(ctxApprovalKey{}, term)
+}
+
+// RequireApproval blocks until the user approves action in the terminal of
+// the SSH connection carrying the request, using DefaultApprovalTimeout.
+//
+//	if err := tunkit.RequireApproval(r, "delete image foo"); err != nil {
+//		http.Error(w, err.Error(), http.StatusForbidden)
+//		return
+//	}
+func RequireApproval(r *http.Request, action string) error {
+	return RequireApprovalTimeout(r, action, DefaultApprovalTimeout)
+}
+
+func RequireApprovalTimeout(r *http.Request, action string, timeout time.Duration) error {
+	sshCtx, err := GetRequestSshCtx(r)
+	if err != nil {
+		return err
+	}
+	return requireApproval(r.Context(), sshCtx, action, timeout)
+}
+
+func requireApproval(reqCtx context.Context, ctx ssh.Context, action string, timeout time.Duration) error {
+	term, err := getApprovalCtx(ctx)
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	term.mu.Lock()
+	defer term.mu.Unlock()
+
+	req := &approvalRequest{
+		action: action,
+		answer: make(chan bool, 1),
+		done:   make(chan struct{}),
+	}
+	defer close(req.done)
+
+	select {
+	case term.requests <- req:
+	case <-term.done:
+		return ErrNoApprovalTerminal
+	case <-timer.C:
+		return ErrApprovalTimeout
+	case <-reqCtx.Done():
+		return reqCtx.Err()
+	}
+
+	select {
+	case approved := <-req.answer:
+		if !approved {
+			return ErrApprovalDenied
+		}
+		return nil
+	case <-term.done:
+		return ErrNoApprovalTerminal
+	case <-timer.C:
+		return ErrApprovalTimeout
+	case <-reqCtx.Done():
+		return reqCtx.Err()
+	}
+}
+
+// readKeys forwards every byte the user types until the session ends.
+func readKeys(sesh ssh.Session) <-chan byte {
+	keys := make(chan byte)
+	go func() {
+		defer close(keys)
+		buf := make([]byte, 1)
+		for {
+			_, err := sesh.Read(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case keys <- buf[0]:
+			case <-sesh.Context().Done():
+				return
+			}
+		}
+	}()
+	return keys
+}
+
+// answerApproval prompts the user and reports false when the session should
+// end (ctrl-c or disconnect).
+func answerApproval(sesh ssh.Session, keys <-chan byte, req *approvalRequest) bool {
+	wish.Printf(sesh, "\napprove %q? [y/N] ", req.action)
+	select {
+	case key, ok := <-keys:
+		if !ok {
+			return false
+		}
+		if key == keyCtrlC {
+			wish.Println(sesh, "")
+			req.answer <- false
+			return false
+		}
+		approved := key == 'y' || key == 'Y'
+		if approved {
+			wish.Println(sesh, "approved")
+		} else {
+			wish.Println(sesh, "denied")
+		}
+		req.answer <- approved
+		return true
+	case <-req.done:
+		wish.Println(sesh, "timed out")
+		return true
+	case <-sesh.Context().Done():
+		return false
+	}
+}
+
+// ApprovalMiddleware turns pty sessions without a command into an approval
+// terminal for RequireApproval. Users keep `ssh -t -L 1338:localhost:80 host`
+// open and answer prompts there; ctrl-c closes the session.
+func ApprovalMiddleware() wish.Middleware {
+	return func(next ssh.Handler) ssh.Handler {
+		return func(sesh ssh.Session) {
+			_, _, activePty := sesh.Pty()
+			if !activePty || len(sesh.Command()) > 0 {
+				next(sesh)
+				return
+			}
+
+			wish.Println(sesh, "waiting for approval requests, press ctrl-c to exit")
+			serveTerminal(sesh, nil, nil)
+		}
+	}
+}
+
+// serveTerminal registers sesh as the connection's approval terminal and
+// blocks until the user presses ctrl-c or disconnects, calling onTick for
+// every tick.
+func serveTerminal(sesh ssh.Session, tick <-chan time.Time, onTick func()) {
+	ctx := sesh.Context()
+	term := &approvalTerminal{
+		requests: make(chan *approvalRequest),
+		done:     make(chan struct{}),
+	}
+	setApprovalCtx(ctx, term)
+	defer func() {
+		setApprovalCtx(ctx, nil)
+		close(term.done)
+	}()
+
+	keys := readKeys(sesh)
+	for {
+		select {
+		case key, ok := <-keys:
+			if !ok || key == keyCtrlC {
+				return
+			}
+		case req := <-term.requests:
+			if !answerApproval(sesh, keys, req) {
+				return
+			}
+		case <-tick:
+			onTick()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
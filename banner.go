@@ -0,0 +1,121 @@
+package tunkit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+)
+
+type BannerOpts struct {
+	// PubSub lists the remote forwards of the connection, optional.
+	PubSub PubSub
+	// Message is printed after the identity, e.g. how to use the service.
+	Message string
+	// Interval between status updates, defaults to 30s.
+	Interval time.Duration
+}
+
+func getRemoteForwards(pubsub PubSub, ctx ssh.Context) []*RemoteForwards {
+	if pubsub == nil {
+		return nil
+	}
+	list := []*RemoteForwards{}
+	for _, rf := range pubsub.GetForwards() {
+		if rf.SessionID == ctx.SessionID() {
+			list = append(list, rf)
+		}
+	}
+	return list
+}
+
+func bannerIdentity(ctx ssh.Context) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "user:        %s\n", ctx.User())
+	fingerprint := GetFingerprint(ctx)
+	if fingerprint != "" {
+		fmt.Fprintf(&sb, "fingerprint: %s\n", fingerprint)
+	}
+	principals := GetPrincipals(ctx)
+	if len(principals) > 0 {
+		fmt.Fprintf(&sb, "principals:  %s\n", strings.Join(principals, ", "))
+	}
+	fmt.Fprintf(&sb, "from:        %s\n", ctx.RemoteAddr())
+	return sb.String()
+}
+
+func bannerForwards(ctx ssh.Context, pubsub PubSub) string {
+	var sb strings.Builder
+
+	locals := GetLocalForwards(ctx)
+	sb.WriteString("local forwards:\n")
+	if len(locals) == 0 {
+		sb.WriteString("  none active, connect to the port you forwarded with -L (e.g. http://localhost:1338)\n")
+	}
+	for _, lf := range locals {
+		fmt.Fprintf(
+			&sb,
+			"  #%d %s:%d from %s:%d (open %s)\n",
+			lf.ID,
+			lf.Addr,
+			lf.Port,
+			lf.OriginAddr,
+			lf.OriginPort,
+			time.Since(lf.Start).Round(time.Second),
+		)
+	}
+
+	if pubsub != nil {
+		remotes := getRemoteForwards(pubsub, ctx)
+		sb.WriteString("remote forwards:\n")
+		if len(remotes) == 0 {
+			sb.WriteString("  none, use -R to register one\n")
+		}
+		for _, rf := range remotes {
+			fmt.Fprintf(&sb, "  listening on %s\n", rf.Listener.Addr())
+		}
+	}
+
+	return sb.String()
+}
+
+// BannerMiddleware greets sessions without a command (users who forgot -N or
+// want feedback) with their identity and active forwards, then keeps the
+// session open with periodic status updates until ctrl-c. It also serves as
+// the terminal for RequireApproval. A nil opts uses the defaults.
+func BannerMiddleware(opts *BannerOpts) wish.Middleware {
+	if opts == nil {
+		opts = &BannerOpts{}
+	}
+	interval := opts.Interval
+	if interval == 0 {
+		interval = 30 * time.Second
+	}
+
+	return func(next ssh.Handler) ssh.Handler {
+		return func(sesh ssh.Session) {
+			if len(sesh.Command()) > 0 {
+				next(sesh)
+				return
+			}
+
+			ctx := sesh.Context()
+			wish.Println(sesh, "tunkit tunnel established")
+			wish.Print(sesh, bannerIdentity(ctx))
+			if opts.Message != "" {
+				wish.Println(sesh, opts.Message)
+			}
+			wish.Print(sesh, bannerForwards(ctx, opts.PubSub))
+			wish.Println(sesh, "press ctrl-c to close the tunnel")
+
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			serveTerminal(sesh, ticker.C, func() {
+				wish.Printf(sesh, "\n[%s]\n", time.Now().Format(time.TimeOnly))
+				wish.Print(sesh, bannerForwards(ctx, opts.PubSub))
+			})
+		}
+	}
+}
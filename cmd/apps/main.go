@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/wish"
+	"github.com/picosh/tunkit"
+)
+
+// app is started once per key and serves on the socket the launcher
+// picked, it stands in for a notebook or admin UI.
+func app() {
+	socket := os.Getenv(tunkit.EnvSocket)
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	started := time.Now()
+	user := os.Getenv(tunkit.EnvUser)
+	_ = http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Hello, %s! Your app (pid %d) is up since %s.\n", user, os.Getpid(), started.Format(time.RFC3339))
+	}))
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "app" {
+		app()
+		return
+	}
+
+	host := os.Getenv("SSH_HOST")
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	port := os.Getenv("SSH_PORT")
+	if port == "" {
+		port = "2222"
+	}
+	keyPath := os.Getenv("SSH_AUTHORIZED_KEYS")
+	if keyPath == "" {
+		keyPath = "ssh_data/authorized_keys"
+	}
+	logger := slog.Default()
+
+	// APP_COMMAND is started per key and must listen on $TUNKIT_SOCKET,
+	// it defaults to the app above
+	command := strings.Fields(os.Getenv("APP_COMMAND"))
+	if len(command) == 0 {
+		self, err := os.Executable()
+		if err != nil {
+			logger.Error("could not find executable", "err", err)
+			os.Exit(1)
+		}
+		command = []string{self, "app"}
+	}
+
+	launcher := tunkit.NewAppLauncher(command, logger)
+	launcher.IdleTimeout = time.Minute
+	handler := tunkit.NewAppTunnelHandler(launcher, logger)
+
+	s, err := wish.NewServer(
+		wish.WithAddress(fmt.Sprintf("%s:%s", host, port)),
+		wish.WithHostKeyPath("ssh_data/term_info_ed25519"),
+		wish.WithAuthorizedKeys(keyPath),
+		tunkit.WithWebTunnel(handler),
+	)
+
+	if err != nil {
+		logger.Error("could not create server", "err", err)
+	}
+
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	logger.Info("starting SSH server", "host", host, "port", port)
+	go func() {
+		if err = s.ListenAndServe(); err != nil {
+			logger.Error("serve error", "err", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-done
+	logger.Info("stopping SSH server")
+	launcher.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer func() { cancel() }()
+	if err := s.Shutdown(ctx); err != nil {
+		logger.Error("shutdown", "err", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/wish"
+	"github.com/picosh/tunkit"
+)
+
+func main() {
+	host := os.Getenv("SSH_HOST")
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	port := os.Getenv("SSH_PORT")
+	if port == "" {
+		port = "2222"
+	}
+	keyPath := os.Getenv("SSH_AUTHORIZED_KEYS")
+	if keyPath == "" {
+		keyPath = "ssh_data/authorized_keys"
+	}
+	// comma separated list of backends, e.g. "10.0.0.1:8080,10.0.0.2:8080"
+	backends := os.Getenv("BACKENDS")
+	if backends == "" {
+		backends = "localhost:8080"
+	}
+	// round-robin (default), least-conns or consistent-key
+	strategy := os.Getenv("BALANCE")
+	logger := slog.Default()
+
+	pool, err := tunkit.NewBackendPool(
+		strings.Split(backends, ","),
+		tunkit.BalanceStrategy(strategy),
+		logger,
+	)
+	if err != nil {
+		logger.Error("could not create backend pool", "err", err)
+		os.Exit(1)
+	}
+	// HEALTH_PATH checks backends over HTTP, otherwise with a TCP connect
+	pool.HealthPath = os.Getenv("HEALTH_PATH")
+	go pool.Watch(context.Background(), 10*time.Second)
+
+	s, err := wish.NewServer(
+		wish.WithAddress(fmt.Sprintf("%s:%s", host, port)),
+		wish.WithHostKeyPath("ssh_data/term_info_ed25519"),
+		wish.WithAuthorizedKeys(keyPath),
+		tunkit.WithTunnel(pool),
+	)
+
+	if err != nil {
+		logger.Error("could not create server", "err", err)
+	}
+
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	logger.Info("starting SSH server", "host", host, "port", port)
+	go func() {
+		if err = s.ListenAndServe(); err != nil {
+			logger.Error("serve error", "err", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-done
+	logger.Info("stopping SSH server")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer func() { cancel() }()
+	if err := s.Shutdown(ctx); err != nil {
+		logger.Error("shutdown", "err", err)
+		os.Exit(1)
+	}
+}
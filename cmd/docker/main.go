@@ -21,6 +21,7 @@ import (
 	"github.com/charmbracelet/ssh"
 	"github.com/charmbracelet/wish"
 	"github.com/picosh/tunkit"
+	gossh "golang.org/x/crypto/ssh"
 )
 
 type ErrorHandler struct {
@@ -49,7 +50,6 @@ func serveMux(ctx ssh.Context) http.Handler {
 	oldDirector := proxy.Director
 
 	proxy.Director = func(r *http.Request) {
-		log.Printf("%+v", r)
 		oldDirector(r)
 
 		if strings.HasSuffix(r.URL.Path, "_catalog") || r.URL.Path == "/v2" || r.URL.Path == "/v2/" {
@@ -76,13 +76,9 @@ func serveMux(ctx ssh.Context) http.Handler {
 
 			r.URL.RawQuery = query.Encode()
 		}
-
-		log.Printf("%+v", r)
 	}
 
 	proxy.ModifyResponse = func(r *http.Response) error {
-		log.Printf("%+v", r)
-
 		if slug != "" && r.Request.Method == http.MethodGet && strings.HasSuffix(r.Request.URL.Path, "_catalog") {
 			b, err := io.ReadAll(r.Body)
 			if err != nil {
@@ -174,7 +170,16 @@ func serveMux(ctx ssh.Context) http.Handler {
 		return nil
 	}
 
-	router.HandleFunc("/", proxy.ServeHTTP)
+	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete && os.Getenv("REQUIRE_APPROVAL") != "" {
+			err := tunkit.RequireApproval(r, fmt.Sprintf("DELETE %s", r.URL.Path))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		proxy.ServeHTTP(w, r)
+	})
 
 	return router
 }
@@ -194,12 +199,65 @@ func main() {
 	}
 	logger := slog.Default()
 
-	s, err := wish.NewServer(
+	handler := tunkit.NewWebTunnelHandler(serveMux, logger)
+	handler.AccessLog = tunkit.NewAccessLog(logger)
+
+	policyPath := os.Getenv("RBAC_POLICY")
+	if policyPath != "" {
+		authz, err := tunkit.NewRBACAuthorizer(policyPath, logger)
+		if err != nil {
+			logger.Error("could not load rbac policy", "err", err)
+			os.Exit(1)
+		}
+		go authz.Watch(context.Background(), 5*time.Second)
+		handler.Authorizer = authz
+	}
+
+	opts := []ssh.Option{
 		wish.WithAddress(fmt.Sprintf("%s:%s", host, port)),
 		wish.WithHostKeyPath("ssh_data/term_info_ed25519"),
 		wish.WithAuthorizedKeys(keyPath),
-		tunkit.WithWebTunnel(tunkit.NewWebTunnelHandler(serveMux, logger)),
+		tunkit.WithAdmissionControl(tunkit.NewAdmissionControl(logger)),
+	}
+
+	// USER_CA trusts user certificates signed by the CA public key so RBAC
+	// principals bindings apply
+	userCAPath := os.Getenv("USER_CA")
+	if userCAPath != "" {
+		data, err := os.ReadFile(userCAPath)
+		if err != nil {
+			logger.Error("could not read user ca", "err", err)
+			os.Exit(1)
+		}
+		userCA, _, _, _, err := gossh.ParseAuthorizedKey(data)
+		if err != nil {
+			logger.Error("could not parse user ca", "err", err)
+			os.Exit(1)
+		}
+		opts = append(opts, tunkit.WithUserCAs(logger, userCA))
+	}
+
+	// a KRL from `ssh-keygen -k` or one fingerprint per line
+	revokedPath := os.Getenv("SSH_REVOKED_KEYS")
+	if revokedPath != "" {
+		revocations, err := tunkit.NewKeyRevocations(revokedPath, logger)
+		if err != nil {
+			logger.Error("could not load key revocations", "err", err)
+			os.Exit(1)
+		}
+		go revocations.Watch(context.Background(), 5*time.Second)
+		opts = append(opts, tunkit.WithKeyRevocations(revocations))
+	}
+
+	opts = append(
+		opts,
+		tunkit.WithWebTunnel(handler),
+		wish.WithMiddleware(
+			tunkit.ApprovalMiddleware(),
+			tunkit.ConnectMiddleware(map[string]tunkit.Tunnel{"registry": handler}),
+		),
 	)
+	s, err := wish.NewServer(opts...)
 
 	if err != nil {
 		logger.Error("could not create server", "err", err)
@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -31,11 +35,11 @@ func authHandler(ctx ssh.Context, key ssh.PublicKey) bool {
 	return true
 }
 
-func serveMux(ctx ssh.Context) http.Handler {
+func serveMux(ctx ssh.Context) (http.Handler, error) {
 	clientName := ctx.User()
 	pubkey, err := getPubkey(ctx)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	fingerprint := keyForSha256(pubkey)
 
@@ -47,7 +51,40 @@ func serveMux(ctx ssh.Context) http.Handler {
 		}
 	})
 
-	return router
+	return router, nil
+}
+
+func serveProxyProtocol(s *ssh.Server, trusted []string, logger *slog.Logger) error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	pln, err := tunkit.NewProxyProtocolListener(ln, trusted, logger)
+	if err != nil {
+		return err
+	}
+	return s.Serve(pln)
+}
+
+// newHostKeyManager starts managed host keys from the key the server used
+// before, so clients that already trust it do not see a changed host key.
+func newHostKeyManager(logger *slog.Logger) (*tunkit.HostKeyManager, error) {
+	dir := "ssh_data/hostkeys"
+	managed := filepath.Join(dir, "ssh_host_ed25519_key")
+	legacy, err := os.ReadFile("ssh_data/term_info_ed25519")
+	if err == nil {
+		if _, err := os.Stat(managed); errors.Is(err, os.ErrNotExist) {
+			err = os.MkdirAll(dir, 0700)
+			if err != nil {
+				return nil, err
+			}
+			err = os.WriteFile(managed, legacy, 0600)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return tunkit.NewHostKeyManager(dir, logger)
 }
 
 func main() {
@@ -61,12 +98,75 @@ func main() {
 	}
 
 	logger := slog.Default()
-	s, err := wish.NewServer(
+	handler := tunkit.NewWebTunnelHandlerErr(serveMux, logger)
+	// shown in the dashboard
+	handler.RequestHistory = true
+
+	hostKeyOpt := wish.WithHostKeyPath("ssh_data/term_info_ed25519")
+	// e.g. HOST_KEY_ROTATE=2160h to rotate every 90 days
+	rotate := os.Getenv("HOST_KEY_ROTATE")
+	caPath := os.Getenv("HOST_CA")
+	if rotate != "" || caPath != "" {
+		hostKeys, err := newHostKeyManager(logger)
+		if err != nil {
+			logger.Error("could not load host keys", "err", err)
+			os.Exit(1)
+		}
+		if rotate != "" {
+			hostKeys.RotateEvery, err = time.ParseDuration(rotate)
+			if err != nil {
+				logger.Error("invalid HOST_KEY_ROTATE", "err", err)
+				os.Exit(1)
+			}
+		}
+		if caPath != "" {
+			caPEM, err := os.ReadFile(caPath)
+			if err != nil {
+				logger.Error("could not read host ca", "err", err)
+				os.Exit(1)
+			}
+			hostKeys.CA, err = gossh.ParsePrivateKey(caPEM)
+			if err != nil {
+				logger.Error("could not parse host ca", "err", err)
+				os.Exit(1)
+			}
+			hostKeys.CertPrincipals = []string{host, "localhost"}
+		}
+		// rotates keys and renews certificates
+		go hostKeys.Watch(context.Background(), time.Hour)
+		hostKeyOpt = tunkit.WithHostKeyManager(hostKeys)
+	}
+
+	opts := []ssh.Option{
 		wish.WithAddress(fmt.Sprintf("%s:%s", host, port)),
-		wish.WithHostKeyPath("ssh_data/term_info_ed25519"),
+		hostKeyOpt,
 		wish.WithPublicKeyAuth(authHandler),
-		tunkit.WithWebTunnel(tunkit.NewWebTunnelHandler(serveMux, logger)),
+		tunkit.WithWebTunnel(handler),
+	}
+	middleware := []wish.Middleware{
+		tunkit.BannerMiddleware(&tunkit.BannerOpts{
+			Message: "open http://localhost:1338 in your browser",
+		}),
+	}
+
+	if os.Getenv("WEB_TLS") != "" {
+		ca, err := tunkit.NewCertAuthority("ssh_data/ca")
+		if err != nil {
+			logger.Error("could not load certificate authority", "err", err)
+			os.Exit(1)
+		}
+		handler.TLSConfig = ca.TLSConfig()
+		middleware = append(middleware, tunkit.CAMiddleware(ca))
+	}
+	middleware = append(
+		middleware,
+		tunkit.NotifyMiddleware(nil),
+		// runs first, pty sessions get the dashboard instead of the banner
+		tunkit.DashboardMiddleware(&tunkit.DashboardOpts{}),
 	)
+	opts = append(opts, wish.WithMiddleware(middleware...))
+
+	s, err := wish.NewServer(opts...)
 
 	if err != nil {
 		logger.Error("could not create server", "err", err)
@@ -76,7 +176,14 @@ func main() {
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 	logger.Info("starting SSH server", "host", host, "port", port)
 	go func() {
-		if err = s.ListenAndServe(); err != nil {
+		// behind a load balancer, e.g. PROXY_TRUSTED=10.0.0.0/8,192.168.1.5
+		trusted := os.Getenv("PROXY_TRUSTED")
+		if trusted == "" {
+			err = s.ListenAndServe()
+		} else {
+			err = serveProxyProtocol(s, strings.Split(trusted, ","), logger)
+		}
+		if err != nil {
 			logger.Error("serve error", "err", err)
 			os.Exit(1)
 		}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/wish"
+	"github.com/picosh/tunkit"
+)
+
+func main() {
+	host := os.Getenv("SSH_HOST")
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	port := os.Getenv("SSH_PORT")
+	if port == "" {
+		port = "2222"
+	}
+	keyPath := os.Getenv("SSH_AUTHORIZED_KEYS")
+	if keyPath == "" {
+		keyPath = "ssh_data/authorized_keys"
+	}
+	// started for every forwarded connection with stdin and stdout as the
+	// connection, e.g. a script reading $TUNKIT_USER
+	command := os.Getenv("EXEC_COMMAND")
+	if command == "" {
+		command = "cat"
+	}
+	logger := slog.Default()
+
+	handler := tunkit.NewExecTunnelHandler(strings.Fields(command), logger)
+	// EXEC_AS_USER=1 runs the command as the local account of the SSH user
+	// when the account's authorized_keys lists the user's key
+	if os.Getenv("EXEC_AS_USER") != "" {
+		handler.Credential = tunkit.LocalUserCredential
+	}
+	handler.Limits = &tunkit.ProcessLimits{
+		NoFile: 256,
+		CPU:    60,
+	}
+
+	s, err := wish.NewServer(
+		wish.WithAddress(fmt.Sprintf("%s:%s", host, port)),
+		wish.WithHostKeyPath("ssh_data/term_info_ed25519"),
+		wish.WithAuthorizedKeys(keyPath),
+		tunkit.WithTunnel(handler),
+	)
+
+	if err != nil {
+		logger.Error("could not create server", "err", err)
+	}
+
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	logger.Info("starting SSH server", "host", host, "port", port)
+	go func() {
+		if err = s.ListenAndServe(); err != nil {
+			logger.Error("serve error", "err", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-done
+	logger.Info("stopping SSH server")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer func() { cancel() }()
+	if err := s.Shutdown(ctx); err != nil {
+		logger.Error("shutdown", "err", err)
+		os.Exit(1)
+	}
+}
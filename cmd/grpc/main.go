@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+	"github.com/picosh/tunkit"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// WhoamiServer is a hand-written gRPC service so the example does not need
+// protoc: it replies with the fingerprint of the caller's SSH key.
+type WhoamiServer interface {
+	Whoami(context.Context, *emptypb.Empty) (*wrapperspb.StringValue, error)
+}
+
+func whoamiHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WhoamiServer).Whoami(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/tunkit.example.Whoami/Whoami",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WhoamiServer).Whoami(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var whoamiServiceDesc = grpc.ServiceDesc{
+	ServiceName: "tunkit.example.Whoami",
+	HandlerType: (*WhoamiServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Whoami",
+			Handler:    whoamiHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+type whoami struct {
+	logger *slog.Logger
+}
+
+func (w *whoami) Whoami(ctx context.Context, _ *emptypb.Empty) (*wrapperspb.StringValue, error) {
+	// the ssh context is available directly ...
+	sshCtx, err := tunkit.GetSshCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// ... and the identity is also available as metadata
+	md, _ := metadata.FromIncomingContext(ctx)
+	w.logger.Info(
+		"whoami",
+		"user", sshCtx.User(),
+		"fingerprint", md.Get("tunkit-fingerprint"),
+	)
+
+	msg := fmt.Sprintf("Hello, %s!\nYour pubkey: %s", sshCtx.User(), tunkit.GetFingerprint(sshCtx))
+	return wrapperspb.String(msg), nil
+}
+
+func authHandler(ctx ssh.Context, key ssh.PublicKey) bool {
+	return true
+}
+
+func client(addr string) {
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	out := new(wrapperspb.StringValue)
+	err = conn.Invoke(ctx, "/tunkit.example.Whoami/Whoami", &emptypb.Empty{}, out)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println(out.GetValue())
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "client" {
+		addr := "localhost:1338"
+		if len(os.Args) > 2 {
+			addr = os.Args[2]
+		}
+		client(addr)
+		return
+	}
+
+	host := os.Getenv("SSH_HOST")
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	port := os.Getenv("SSH_PORT")
+	if port == "" {
+		port = "2222"
+	}
+
+	logger := slog.Default()
+	grpcServer := grpc.NewServer()
+	grpcServer.RegisterService(&whoamiServiceDesc, &whoami{logger: logger})
+
+	handler := tunkit.NewWebTunnelHandler(func(ctx ssh.Context) http.Handler {
+		return grpcServer
+	}, logger)
+	handler.H2C = true
+	handler.IdentityHeaders = true
+
+	s, err := wish.NewServer(
+		wish.WithAddress(fmt.Sprintf("%s:%s", host, port)),
+		wish.WithHostKeyPath("ssh_data/term_info_ed25519"),
+		wish.WithPublicKeyAuth(authHandler),
+		tunkit.WithWebTunnel(handler),
+	)
+
+	if err != nil {
+		logger.Error("could not create server", "err", err)
+	}
+
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	logger.Info("starting SSH server", "host", host, "port", port)
+	go func() {
+		if err = s.ListenAndServe(); err != nil {
+			logger.Error("serve error", "err", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-done
+	logger.Info("stopping SSH server")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer func() { cancel() }()
+	if err := s.Shutdown(ctx); err != nil {
+		logger.Error("shutdown", "err", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/wish"
+	"github.com/picosh/tunkit"
+)
+
+func main() {
+	host := os.Getenv("SSH_HOST")
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	port := os.Getenv("SSH_PORT")
+	if port == "" {
+		port = "2222"
+	}
+	keyPath := os.Getenv("SSH_AUTHORIZED_KEYS")
+	if keyPath == "" {
+		keyPath = "ssh_data/authorized_keys"
+	}
+	// comma separated list of destinations, e.g. "*.internal,registry:5000,10.0.0.0/8"
+	allow := os.Getenv("PROXY_ALLOW")
+	if allow == "" {
+		allow = "localhost"
+	}
+	logger := slog.Default()
+
+	proxy := tunkit.NewForwardProxy(
+		tunkit.AllowDestinations(strings.Split(allow, ",")...),
+		logger,
+	)
+	handler := tunkit.NewWebTunnelHandler(proxy.HttpHandler, logger)
+	handler.AccessLog = tunkit.NewAccessLog(logger)
+
+	s, err := wish.NewServer(
+		wish.WithAddress(fmt.Sprintf("%s:%s", host, port)),
+		wish.WithHostKeyPath("ssh_data/term_info_ed25519"),
+		wish.WithAuthorizedKeys(keyPath),
+		tunkit.WithWebTunnel(handler),
+	)
+
+	if err != nil {
+		logger.Error("could not create server", "err", err)
+	}
+
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	logger.Info("starting SSH server", "host", host, "port", port)
+	go func() {
+		if err = s.ListenAndServe(); err != nil {
+			logger.Error("serve error", "err", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-done
+	logger.Info("stopping SSH server")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer func() { cancel() }()
+	if err := s.Shutdown(ctx); err != nil {
+		logger.Error("shutdown", "err", err)
+		os.Exit(1)
+	}
+}
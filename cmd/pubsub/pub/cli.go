@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 
@@ -27,6 +29,10 @@ func CliMiddleware(handler tunkit.PubSub) wish.Middleware {
 			}
 
 			args := sesh.Command()
+			if len(args) == 0 {
+				next(sesh)
+				return
+			}
 			forwards := handler.GetForwards()
 
 			cmd := strings.TrimSpace(args[0])
@@ -56,7 +62,16 @@ func CliMiddleware(handler tunkit.PubSub) wish.Middleware {
 					wish.Printf(sesh, "[GET] %s\n", furl)
 					logger.Info("emitting to listener")
 
-					_, err := http.Get(furl)
+					// dial through the forward, it can be in the key's
+					// network namespace
+					client := &http.Client{
+						Transport: &http.Transport{
+							DialContext: func(context.Context, string, string) (net.Conn, error) {
+								return rf.Dial()
+							},
+						},
+					}
+					_, err := client.Get(furl)
 					if err != nil {
 						logger.Error("unable send message", "err", err)
 					}
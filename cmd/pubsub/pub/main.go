@@ -24,12 +24,21 @@ func main() {
 
 	logger := slog.Default()
 	handler := tunkit.NewPubSubHandler(logger)
+	// ISOLATE_KEYS=1 binds each key's forwards in its own network namespace
+	// (linux, run as root)
+	handler.IsolateKeys = os.Getenv("ISOLATE_KEYS") != ""
 	s, err := wish.NewServer(
 		wish.WithAddress(fmt.Sprintf("%s:%s", host, port)),
 		wish.WithHostKeyPath("ssh_data/term_info_ed25519"),
 		wish.WithPublicKeyAuth(authHandler),
 		tunkit.WithPubSub(handler),
-		wish.WithMiddleware(CliMiddleware(handler)),
+		wish.WithMiddleware(
+			tunkit.BannerMiddleware(&tunkit.BannerOpts{PubSub: handler}),
+			CliMiddleware(handler),
+			tunkit.NotifyMiddleware(nil),
+			// runs first, pty sessions get the dashboard with their -R forwards
+			tunkit.DashboardMiddleware(&tunkit.DashboardOpts{PubSub: handler}),
+		),
 	)
 
 	if err != nil {
@@ -3,9 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
-	"io"
 	"log/slog"
-	"net"
 	"os"
 	"os/signal"
 	"syscall"
@@ -17,61 +15,41 @@ import (
 	gossh "golang.org/x/crypto/ssh"
 )
 
-type handler struct {
-	logger *slog.Logger
-}
-
-func (h *handler) CreateConn(ctx ssh.Context) (net.Conn, error) {
-	rawConn, err := net.Dial("tcp", os.Getenv("REMOTE_HOST"))
-	if err != nil {
-		return nil, err
-	}
-
-	f, err := os.Open(os.Getenv("KEY_LOCATION"))
+func loadSigner() (gossh.Signer, error) {
+	data, err := os.ReadFile(os.Getenv("KEY_LOCATION"))
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-
-	data, err := io.ReadAll(f)
-	if err != nil {
-		return nil, err
-	}
-
-	var signer gossh.Signer
 
 	if os.Getenv("KEY_PASSPHRASE") != "" {
-		signer, err = gossh.ParsePrivateKeyWithPassphrase(data, []byte(os.Getenv("KEY_PASSPHRASE")))
-	} else {
-		signer, err = gossh.ParsePrivateKey(data)
-	}
-
-	if err != nil {
-		return nil, err
+		return gossh.ParsePrivateKeyWithPassphrase(data, []byte(os.Getenv("KEY_PASSPHRASE")))
 	}
+	return gossh.ParsePrivateKey(data)
+}
 
-	sshConn, chans, reqs, err := gossh.NewClientConn(rawConn, os.Getenv("REMOTE_HOSTNAME"), &gossh.ClientConfig{
-		Auth:            []gossh.AuthMethod{gossh.PublicKeys(signer)},
-		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+func envUpstream(logger *slog.Logger) *tunkit.Upstream {
+	upstream := &tunkit.Upstream{
+		Addr:            os.Getenv("REMOTE_HOST"),
 		User:            os.Getenv("REMOTE_USER"),
-	})
-	if err != nil {
-		return nil, err
+		Network:         os.Getenv("REMOTE_PROTOCOL"),
+		Dest:            os.Getenv("REMOTE_ADDRESS"),
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
 	}
-	sshClient := gossh.NewClient(sshConn, chans, reqs)
-	return sshClient.Dial(os.Getenv("REMOTE_PROTOCOL"), os.Getenv("REMOTE_ADDRESS"))
-}
-
-func (h *handler) GetLogger() *slog.Logger {
-	return h.logger
-}
-
-func (h *handler) Close(ctx ssh.Context) error {
-	return nil
+	// AGENT_FORWARD=1 authenticates upstream as the connecting user with
+	// the agent they forwarded (`ssh -A`) instead of the shared key
+	if os.Getenv("AGENT_FORWARD") != "" {
+		upstream.UseAgent = true
+	} else {
+		signer, err := loadSigner()
+		if err != nil {
+			logger.Error("could not load upstream key", "err", err)
+			os.Exit(1)
+		}
+		upstream.Signer = signer
+	}
+	return upstream
 }
 
-var _ tunkit.Tunnel = &handler{}
-
 func main() {
 	host := os.Getenv("SSH_HOST")
 	if host == "" {
@@ -87,14 +65,58 @@ func main() {
 	}
 	logger := slog.Default()
 
-	s, err := wish.NewServer(
+	handler := tunkit.NewSSHTunnelHandler(nil, logger)
+	// UPSTREAM_CONFIG maps users to their own upstream, see
+	// tunkit.UpstreamConfig, otherwise everyone uses the REMOTE_* upstream
+	configPath := os.Getenv("UPSTREAM_CONFIG")
+	if configPath != "" {
+		config, err := tunkit.LoadUpstreamConfig(configPath)
+		if err != nil {
+			logger.Error("could not load upstream config", "err", err)
+			os.Exit(1)
+		}
+		handler.Resolver = config
+	} else {
+		handler.Upstream = envUpstream(logger)
+	}
+
+	var tunnel tunkit.Tunnel = handler
+	// FAULT_LATENCY (e.g. 300ms) slows every forward down to see how
+	// clients behave on a bad network
+	latency, _ := time.ParseDuration(os.Getenv("FAULT_LATENCY"))
+	if latency > 0 {
+		faults := tunkit.NewFaultInjector(&tunkit.Faults{
+			Latency: latency,
+			Jitter:  latency / 2,
+		})
+		tunnel = tunkit.WrapTunnel(handler, faults.Decorator())
+	}
+
+	opts := []ssh.Option{
 		wish.WithAddress(fmt.Sprintf("%s:%s", host, port)),
 		wish.WithHostKeyPath("ssh_data/term_info_ed25519"),
 		wish.WithAuthorizedKeys(keyPath),
-		tunkit.WithTunnel(&handler{
-			logger: logger,
-		}),
-	)
+		tunkit.WithTunnel(tunnel),
+	}
+
+	// USER_CA trusts user certificates signed by the CA public key so
+	// upstream mappings can match their principals
+	userCAPath := os.Getenv("USER_CA")
+	if userCAPath != "" {
+		data, err := os.ReadFile(userCAPath)
+		if err != nil {
+			logger.Error("could not read user ca", "err", err)
+			os.Exit(1)
+		}
+		userCA, _, _, _, err := gossh.ParseAuthorizedKey(data)
+		if err != nil {
+			logger.Error("could not parse user ca", "err", err)
+			os.Exit(1)
+		}
+		opts = append(opts, tunkit.WithUserCAs(logger, userCA))
+	}
+
+	s, err := wish.NewServer(opts...)
 
 	if err != nil {
 		logger.Error("could not create server", "err", err)
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+	"github.com/picosh/tunkit"
+)
+
+func serveMux(ctx ssh.Context) http.Handler {
+	router := http.NewServeMux()
+	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Hello, %s! You tunneled over a websocket.\n", ctx.User())
+	})
+	return router
+}
+
+func authHandler(ctx ssh.Context, key ssh.PublicKey) bool {
+	return true
+}
+
+// client bridges stdin and stdout to the websocket so it can be used as a
+// ProxyCommand:
+//
+//	ssh -o ProxyCommand="websocket client ws://localhost:8080/ssh" -L 1338:localhost:80 localhost
+func client(url string) {
+	conn, err := tunkit.DialWebSocket(url, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	go func() {
+		_, _ = io.Copy(conn, os.Stdin)
+		conn.Close()
+	}()
+	_, _ = io.Copy(os.Stdout, conn)
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "client" {
+		url := "ws://localhost:8080/ssh"
+		if len(os.Args) > 2 {
+			url = os.Args[2]
+		}
+		client(url)
+		return
+	}
+
+	host := os.Getenv("SSH_HOST")
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	port := os.Getenv("SSH_PORT")
+	if port == "" {
+		port = "2222"
+	}
+	wsPort := os.Getenv("WS_PORT")
+	if wsPort == "" {
+		wsPort = "8080"
+	}
+
+	logger := slog.Default()
+	handler := tunkit.NewWebTunnelHandler(serveMux, logger)
+
+	s, err := wish.NewServer(
+		wish.WithAddress(fmt.Sprintf("%s:%s", host, port)),
+		wish.WithHostKeyPath("ssh_data/term_info_ed25519"),
+		wish.WithPublicKeyAuth(authHandler),
+		tunkit.WithWebTunnel(handler),
+	)
+
+	if err != nil {
+		logger.Error("could not create server", "err", err)
+	}
+
+	ws := tunkit.NewWebSocketListener(logger)
+	router := http.NewServeMux()
+	router.Handle("/ssh", ws)
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf("%s:%s", host, wsPort),
+		Handler: router,
+	}
+
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+	logger.Info("starting SSH server", "host", host, "port", port, "wsPort", wsPort)
+	go func() {
+		if err = s.ListenAndServe(); err != nil {
+			logger.Error("serve error", "err", err)
+			os.Exit(1)
+		}
+	}()
+	go func() {
+		if err := s.Serve(ws); err != nil {
+			logger.Error("websocket serve error", "err", err)
+		}
+	}()
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil {
+			logger.Error("http serve error", "err", err)
+		}
+	}()
+
+	<-done
+	logger.Info("stopping SSH server")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer func() { cancel() }()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		logger.Error("http shutdown", "err", err)
+	}
+	if err := s.Shutdown(ctx); err != nil {
+		logger.Error("shutdown", "err", err)
+		os.Exit(1)
+	}
+}
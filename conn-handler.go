@@ -0,0 +1,170 @@
+package tunkit
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+)
+
+type ctxConnSetKey struct{}
+
+type connSet struct {
+	sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func getConnSetCtx(ctx ssh.Context) *connSet {
+	ctx.Lock()
+	defer ctx.Unlock()
+	set, ok := ctx.Value(ctxConnSetKey{}).(*connSet)
+	if set == nil || !ok {
+		set = &connSet{conns: map[net.Conn]struct{}{}}
+		ctx.SetValue(ctxConnSetKey{}, set)
+	}
+	return set
+}
+
+// pipeConn is one end of a halfPipe, it reads from one net.Pipe and writes
+// to another so each direction can be closed on its own.
+type pipeConn struct {
+	r net.Conn
+	w net.Conn
+}
+
+// halfPipe is net.Pipe with CloseWrite: closing the write side of one end
+// gives the other end EOF while it can still write back.
+func halfPipe() (*pipeConn, *pipeConn) {
+	r1, w1 := net.Pipe()
+	r2, w2 := net.Pipe()
+	return &pipeConn{r: r1, w: w2}, &pipeConn{r: r2, w: w1}
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func (c *pipeConn) CloseWrite() error {
+	return c.w.Close()
+}
+
+func (c *pipeConn) Close() error {
+	return errors.Join(c.w.Close(), c.r.Close())
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.r.LocalAddr()
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.r.RemoteAddr()
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	return errors.Join(c.r.SetReadDeadline(t), c.w.SetWriteDeadline(t))
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	return c.r.SetReadDeadline(t)
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	return c.w.SetWriteDeadline(t)
+}
+
+// sshConn is the server side of a ConnTunnel channel. It reports the SSH
+// client's addresses instead of the in-memory pipe's.
+type sshConn struct {
+	*pipeConn
+	ctx ssh.Context
+}
+
+func (c *sshConn) LocalAddr() net.Addr {
+	return c.ctx.LocalAddr()
+}
+
+func (c *sshConn) RemoteAddr() net.Addr {
+	return c.ctx.RemoteAddr()
+}
+
+// ConnTunnelHandler hands every direct-tcpip channel to ServeConn as a
+// net.Conn so any protocol can be served with access to the SSH identity.
+type ConnTunnelHandler struct {
+	ServeConn ServeConnFn
+	Logger    *slog.Logger
+	// MaxConns limits the number of concurrent channels per SSH connection,
+	// zero means unlimited.
+	MaxConns int
+}
+
+func NewConnTunnelHandler(serveConn ServeConnFn, logger *slog.Logger) *ConnTunnelHandler {
+	return &ConnTunnelHandler{
+		ServeConn: serveConn,
+		Logger:    logger,
+	}
+}
+
+func (ct *ConnTunnelHandler) GetLogger() *slog.Logger {
+	return ct.Logger
+}
+
+func (ct *ConnTunnelHandler) GetServeConn() ServeConnFn {
+	return ct.ServeConn
+}
+
+func (ct *ConnTunnelHandler) Close(ctx ssh.Context) error {
+	set := getConnSetCtx(ctx)
+	set.Lock()
+	defer set.Unlock()
+	for conn := range set.conns {
+		_ = conn.Close()
+		delete(set.conns, conn)
+	}
+	return nil
+}
+
+func (ct *ConnTunnelHandler) CreateConn(ctx ssh.Context) (net.Conn, error) {
+	set := getConnSetCtx(ctx)
+	set.Lock()
+	if ct.MaxConns > 0 && len(set.conns) >= ct.MaxConns {
+		set.Unlock()
+		return nil, fmt.Errorf("connection limit reached (%d)", ct.MaxConns)
+	}
+	// the client end half-closes when the SSH client sends EOF so ServeConn
+	// can still write its response
+	client, server := halfPipe()
+	conn := &sshConn{pipeConn: server, ctx: ctx}
+	set.conns[conn] = struct{}{}
+	set.Unlock()
+
+	log := ct.GetLogger().With(
+		"user", ctx.User(),
+		"sessionID", ctx.SessionID(),
+	)
+
+	go func() {
+		defer func() {
+			set.Lock()
+			delete(set.conns, conn)
+			set.Unlock()
+			_ = conn.Close()
+		}()
+		defer func() {
+			if r := recover(); r != nil {
+				log.Error("serve conn panic", "err", r)
+			}
+		}()
+		serve := ct.GetServeConn()
+		serve(ctx, conn)
+	}()
+
+	return client, nil
+}
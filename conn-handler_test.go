@@ -0,0 +1,110 @@
+package tunkit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// testContext is an ssh.Context for handlers called outside of a server.
+type testContext struct {
+	context.Context
+	*sync.Mutex
+
+	user     string
+	valuesMu sync.Mutex
+	values   map[any]any
+}
+
+func newTestContext(t *testing.T, user string) *testContext {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &testContext{
+		Context: ctx,
+		Mutex:   &sync.Mutex{},
+		user:    user,
+		values:  map[any]any{},
+	}
+}
+
+func (c *testContext) Value(key any) any {
+	c.valuesMu.Lock()
+	defer c.valuesMu.Unlock()
+	if v, ok := c.values[key]; ok {
+		return v
+	}
+	return c.Context.Value(key)
+}
+
+func (c *testContext) SetValue(key, value any) {
+	c.valuesMu.Lock()
+	defer c.valuesMu.Unlock()
+	c.values[key] = value
+}
+
+func (c *testContext) User() string          { return c.user }
+func (c *testContext) SessionID() string     { return "test" }
+func (c *testContext) ClientVersion() string { return "SSH-2.0-test" }
+func (c *testContext) ServerVersion() string { return "SSH-2.0-tunkit" }
+
+func (c *testContext) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+}
+
+func (c *testContext) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}
+}
+
+func (c *testContext) Permissions() *ssh.Permissions {
+	return &ssh.Permissions{Permissions: &gossh.Permissions{}}
+}
+
+func TestConnTunnelHalfClose(t *testing.T) {
+	handler := NewConnTunnelHandler(func(ctx ssh.Context, conn net.Conn) {
+		// read the whole request, then answer
+		data, err := io.ReadAll(conn)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(conn, "%s read %d bytes\n", ctx.User(), len(data))
+	}, slog.Default())
+
+	ctx := newTestContext(t, "alice")
+	conn, err := handler.CreateConn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte("PING\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatal("ConnTunnel conn does not support CloseWrite")
+	}
+	err = cw.CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading the response after CloseWrite: %v", err)
+	}
+	if line != "alice read 5 bytes\n" {
+		t.Errorf("response = %q, want %q", line, "alice read 5 bytes\n")
+	}
+}
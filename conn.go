@@ -0,0 +1,21 @@
+package tunkit
+
+import (
+	"log/slog"
+	"net"
+
+	"github.com/charmbracelet/ssh"
+)
+
+type ServeConnFn = func(ctx ssh.Context, conn net.Conn)
+
+type ConnTunnel interface {
+	GetServeConn() ServeConnFn
+	CreateConn(ctx ssh.Context) (net.Conn, error)
+	GetLogger() *slog.Logger
+	Close(ctx ssh.Context) error
+}
+
+func WithConnTunnel(handler ConnTunnel) ssh.Option {
+	return WithTunnel(handler)
+}
@@ -0,0 +1,129 @@
+package tunkit
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ConnectMiddleware adds a `connect <dest>` session command that bridges the
+// session's stdin and stdout to the tunnel registered as dest. It is meant
+// for clients and jump hosts that disable port forwarding but allow exec
+// sessions:
+//
+//	ssh -p 2222 localhost connect registry
+//	ssh -o ProxyCommand="ssh -p 2222 localhost connect web" ...
+//
+// Web tunnels are served by the same http server (and Authorizer) as
+// direct-tcpip forwards. The session exits with 1 when the bridge fails, and
+// on servers set up with WithTunnel closing the session closes the conn.
+func ConnectMiddleware(tunnels map[string]Tunnel) wish.Middleware {
+	return func(next ssh.Handler) ssh.Handler {
+		return func(sesh ssh.Session) {
+			args := sesh.Command()
+			if len(args) == 0 || strings.TrimSpace(args[0]) != "connect" {
+				next(sesh)
+				return
+			}
+
+			if len(args) != 2 {
+				wish.Fatalln(sesh, "usage: connect <dest>")
+				return
+			}
+
+			dest := args[1]
+			handler, ok := tunnels[dest]
+			if !ok {
+				names := []string{}
+				for name := range tunnels {
+					names = append(names, name)
+				}
+				slices.Sort(names)
+				wish.Fatalf(sesh, "unknown destination %q, available: %s\n", dest, strings.Join(names, ", "))
+				return
+			}
+
+			ctx := sesh.Context()
+			log := handler.GetLogger().With(
+				"dest", dest,
+				"user", ctx.User(),
+				"fingerprint", GetFingerprint(ctx),
+				"sessionID", ctx.SessionID(),
+			)
+			log.Info("stdio bridge request")
+
+			downConn, err := handler.CreateConn(ctx)
+			if err != nil {
+				log.Error("unable to connect to conn", "err", err)
+				Notify(ctx, slog.LevelError, fmt.Sprintf("connect to %s failed", dest), err)
+				wish.Fatalln(sesh, err)
+				return
+			}
+
+			// mirror direct-tcpip which closes the conn with the channel and
+			// the tunnel with the connection. bridgeConn only half-closes the
+			// conn on the client's EOF, a backend that never answers would
+			// otherwise keep it open.
+			go func() {
+				select {
+				case <-sessionClosed(ctx):
+				case <-ctx.Done():
+				}
+				downConn.Close()
+			}()
+			go func() {
+				<-ctx.Done()
+				err := handler.Close(ctx)
+				if err != nil {
+					log.Error("tunnel handler error", "err", err)
+				}
+			}()
+
+			err = bridgeConn(ctx, log, sesh, downConn, &LocalForward{
+				Addr:       dest,
+				OriginAddr: "stdio",
+			})
+			if err != nil {
+				_ = sesh.Exit(1)
+				return
+			}
+			_ = sesh.Exit(0)
+		}
+	}
+}
+
+type ctxSessionClosedKey struct{}
+
+// sessionContext is a session's view of the connection context, it only adds
+// a channel closed with the session.
+type sessionContext struct {
+	ssh.Context
+	closed chan struct{}
+}
+
+func (c *sessionContext) Value(key any) any {
+	if key == (ctxSessionClosedKey{}) {
+		return c.closed
+	}
+	return c.Context.Value(key)
+}
+
+// sessionHandler is ssh.DefaultSessionHandler, which returns once the
+// session's channel is closed, with a context that reports it.
+func sessionHandler(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	closed := make(chan struct{})
+	defer close(closed)
+	ssh.DefaultSessionHandler(srv, conn, newChan, &sessionContext{Context: ctx, closed: closed})
+}
+
+// sessionClosed is closed with the session of ctx, nil when the server was
+// not set up by WithTunnel.
+func sessionClosed(ctx ssh.Context) <-chan struct{} {
+	closed, _ := ctx.Value(ctxSessionClosedKey{}).(chan struct{})
+	return closed
+}
@@ -0,0 +1,309 @@
+package tunkit
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+	bm "github.com/charmbracelet/wish/bubbletea"
+)
+
+var dashboardEvents = 5
+
+type DashboardOpts struct {
+	// PubSub lists the remote forwards of the connection, optional.
+	PubSub PubSub
+	// Interval between refreshes, defaults to 1s.
+	Interval time.Duration
+}
+
+type dashboardTickMsg time.Time
+type dashboardEventMsg Event
+
+// dashboardRow is a selectable forward, either local or remote.
+type dashboardRow struct {
+	local  *LocalForward
+	remote *RemoteForwards
+}
+
+type rate struct {
+	in  float64
+	out float64
+}
+
+type dashboardModel struct {
+	ctx      ssh.Context
+	opts     *DashboardOpts
+	interval time.Duration
+	eventCh  <-chan Event
+	styles   dashboardStyles
+
+	rows    []dashboardRow
+	cursor  int
+	sampled time.Time
+	totals  map[int][2]int64
+	rates   map[int]rate
+	events  []Event
+}
+
+type dashboardStyles struct {
+	title    lipgloss.Style
+	header   lipgloss.Style
+	selected lipgloss.Style
+	err      lipgloss.Style
+	help     lipgloss.Style
+}
+
+func newDashboardStyles(renderer *lipgloss.Renderer) dashboardStyles {
+	return dashboardStyles{
+		title:    renderer.NewStyle().Bold(true),
+		header:   renderer.NewStyle().Bold(true).Underline(true),
+		selected: renderer.NewStyle().Reverse(true),
+		err:      renderer.NewStyle().Foreground(lipgloss.Color("1")),
+		help:     renderer.NewStyle().Faint(true),
+	}
+}
+
+func (m *dashboardModel) tick() tea.Cmd {
+	return tea.Tick(m.interval, func(t time.Time) tea.Msg {
+		return dashboardTickMsg(t)
+	})
+}
+
+func (m *dashboardModel) waitEvent() tea.Cmd {
+	return func() tea.Msg {
+		ev, ok := <-m.eventCh
+		if !ok {
+			return nil
+		}
+		return dashboardEventMsg(ev)
+	}
+}
+
+func (m *dashboardModel) refresh() {
+	rows := []dashboardRow{}
+	rates := map[int]rate{}
+	totals := map[int][2]int64{}
+	// closing a forward refreshes mid-interval, so rates use the time since
+	// the last sample rather than the interval
+	now := time.Now()
+	secs := now.Sub(m.sampled).Seconds()
+
+	for _, lf := range GetLocalForwards(m.ctx) {
+		rows = append(rows, dashboardRow{local: lf})
+		in, out := lf.BytesIn.Load(), lf.BytesOut.Load()
+		prev := m.totals[lf.ID]
+		totals[lf.ID] = [2]int64{in, out}
+		if m.sampled.IsZero() || secs <= 0 {
+			continue
+		}
+		rates[lf.ID] = rate{
+			in:  float64(in-prev[0]) / secs,
+			out: float64(out-prev[1]) / secs,
+		}
+	}
+	for _, rf := range getRemoteForwards(m.opts.PubSub, m.ctx) {
+		rows = append(rows, dashboardRow{remote: rf})
+	}
+
+	m.rows = rows
+	m.rates = rates
+	m.totals = totals
+	m.sampled = now
+	if m.cursor >= len(m.rows) {
+		m.cursor = max(len(m.rows)-1, 0)
+	}
+}
+
+func (m *dashboardModel) closeSelected() {
+	if len(m.rows) == 0 {
+		return
+	}
+	row := m.rows[m.cursor]
+	if row.local != nil {
+		err := row.local.Close()
+		if err != nil {
+			Notify(m.ctx, slog.LevelError, fmt.Sprintf("closing local forward #%d", row.local.ID), err)
+		}
+	}
+	if row.remote != nil {
+		err := row.remote.Listener.Close()
+		if err != nil {
+			Notify(m.ctx, slog.LevelError, fmt.Sprintf("closing remote forward %s", row.remote.Listener.Addr()), err)
+		}
+	}
+}
+
+func (m *dashboardModel) Init() tea.Cmd {
+	return tea.Batch(m.tick(), m.waitEvent())
+}
+
+func (m *dashboardModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case dashboardTickMsg:
+		m.refresh()
+		return m, m.tick()
+	case dashboardEventMsg:
+		m.events = append(m.events, Event(msg))
+		if len(m.events) > dashboardEvents {
+			m.events = m.events[len(m.events)-dashboardEvents:]
+		}
+		return m, m.waitEvent()
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "q", "ctrl+c":
+			return m, tea.Quit
+		case "up", "k":
+			if m.cursor > 0 {
+				m.cursor -= 1
+			}
+		case "down", "j":
+			if m.cursor < len(m.rows)-1 {
+				m.cursor += 1
+			}
+		case "x", "d", "delete":
+			m.closeSelected()
+			m.refresh()
+		}
+	}
+	return m, nil
+}
+
+func humanBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i += 1
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
+
+func (m *dashboardModel) View() string {
+	var sb strings.Builder
+	sb.WriteString(m.styles.title.Render(fmt.Sprintf("tunkit: %s", m.ctx.User())))
+	sb.WriteString("\n")
+	sb.WriteString(GetFingerprint(m.ctx))
+	sb.WriteString("\n\n")
+
+	sb.WriteString(m.styles.header.Render("forwards"))
+	sb.WriteString("\n")
+	if len(m.rows) == 0 {
+		sb.WriteString("  none\n")
+	}
+	for i, row := range m.rows {
+		var line string
+		if row.local != nil {
+			lf := row.local
+			r := m.rates[lf.ID]
+			line = fmt.Sprintf(
+				"local  #%d %s:%d  in %s (%s/s)  out %s (%s/s)  %s",
+				lf.ID,
+				lf.Addr,
+				lf.Port,
+				humanBytes(float64(lf.BytesIn.Load())),
+				humanBytes(r.in),
+				humanBytes(float64(lf.BytesOut.Load())),
+				humanBytes(r.out),
+				time.Since(lf.Start).Round(time.Second),
+			)
+		} else {
+			line = fmt.Sprintf("remote %s", row.remote.Listener.Addr())
+		}
+
+		if i == m.cursor {
+			sb.WriteString(m.styles.selected.Render("> " + line))
+		} else {
+			sb.WriteString("  " + line)
+		}
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString("\n")
+	sb.WriteString(m.styles.header.Render("recent requests"))
+	sb.WriteString("\n")
+	requests := GetRecentRequests(m.ctx)
+	if len(requests) == 0 {
+		sb.WriteString("  none\n")
+	}
+	for i := len(requests) - 1; i >= 0 && i >= len(requests)-10; i-- {
+		req := requests[i]
+		fmt.Fprintf(
+			&sb,
+			"  %s %d %s %s (%s)\n",
+			req.Time.Format(time.TimeOnly),
+			req.Status,
+			req.Method,
+			req.Path,
+			req.Duration.Round(time.Millisecond),
+		)
+	}
+
+	sb.WriteString("\n")
+	sb.WriteString(m.styles.header.Render("events"))
+	sb.WriteString("\n")
+	if len(m.events) == 0 {
+		sb.WriteString("  none\n")
+	}
+	for _, ev := range m.events {
+		line := fmt.Sprintf("  %s %s", ev.Time.Format(time.TimeOnly), ev)
+		if ev.Err != nil {
+			line = m.styles.err.Render(line)
+		}
+		sb.WriteString(line)
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString("\n")
+	sb.WriteString(m.styles.help.Render("↑/↓ select • x close forward • q quit"))
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// DashboardMiddleware shows a live dashboard of the connection's tunnels to
+// users who connect with a pty and no command (`ssh -t host`). A nil opts
+// uses the defaults.
+func DashboardMiddleware(opts *DashboardOpts) wish.Middleware {
+	if opts == nil {
+		opts = &DashboardOpts{}
+	}
+	interval := opts.Interval
+	if interval == 0 {
+		interval = time.Second
+	}
+
+	return func(next ssh.Handler) ssh.Handler {
+		return func(sesh ssh.Session) {
+			_, _, activePty := sesh.Pty()
+			if !activePty || len(sesh.Command()) > 0 {
+				next(sesh)
+				return
+			}
+
+			// the subscription lives as long as the dashboard, the connection
+			// can outlive it with its tunnels
+			ctx := sesh.Context()
+			events, unsubscribe := SubscribeEvents(ctx)
+			defer unsubscribe()
+
+			teaHandler := func(sesh ssh.Session) (tea.Model, []tea.ProgramOption) {
+				m := &dashboardModel{
+					ctx:      ctx,
+					opts:     opts,
+					interval: interval,
+					eventCh:  events,
+					styles:   newDashboardStyles(bm.MakeRenderer(sesh)),
+					totals:   map[int][2]int64{},
+				}
+				m.refresh()
+				return m, []tea.ProgramOption{tea.WithAltScreen()}
+			}
+			bm.Middleware(teaHandler)(func(ssh.Session) {})(sesh)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package tunkit
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+)
+
+// LocalForward is an open direct-tcpip channel of an SSH connection.
+type LocalForward struct {
+	ID         int
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+	Start      time.Time
+	// BytesIn counts bytes from the SSH client to the tunnel and BytesOut
+	// bytes from the tunnel back to the client.
+	BytesIn  atomic.Int64
+	BytesOut atomic.Int64
+
+	close func() error
+}
+
+// Close tears down the channel.
+func (lf *LocalForward) Close() error {
+	return lf.close()
+}
+
+type forwardSet struct {
+	sync.Mutex
+	nextID   int
+	forwards map[int]*LocalForward
+}
+
+type ctxForwardSetKey struct{}
+
+func getForwardSetCtx(ctx ssh.Context) *forwardSet {
+	ctx.Lock()
+	defer ctx.Unlock()
+	set, ok := ctx.Value(ctxForwardSetKey{}).(*forwardSet)
+	if set == nil || !ok {
+		set = &forwardSet{forwards: map[int]*LocalForward{}}
+		ctx.SetValue(ctxForwardSetKey{}, set)
+	}
+	return set
+}
+
+func addLocalForward(ctx ssh.Context, lf *LocalForward) func() {
+	set := getForwardSetCtx(ctx)
+	set.Lock()
+	defer set.Unlock()
+	set.nextID += 1
+	lf.ID = set.nextID
+	set.forwards[lf.ID] = lf
+
+	return func() {
+		set.Lock()
+		defer set.Unlock()
+		delete(set.forwards, lf.ID)
+	}
+}
+
+// GetLocalForwards returns the open direct-tcpip channels of the connection,
+// oldest first.
+func GetLocalForwards(ctx ssh.Context) []*LocalForward {
+	set := getForwardSetCtx(ctx)
+	set.Lock()
+	defer set.Unlock()
+
+	list := []*LocalForward{}
+	for _, lf := range set.forwards {
+		list = append(list, lf)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+type countingWriter struct {
+	w     io.Writer
+	count *atomic.Int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.count.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,567 @@
+package tunkit
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+var (
+	HostKeyEd25519 = "ed25519"
+	HostKeyECDSA   = "ecdsa"
+	HostKeyRSA     = "rsa"
+
+	hostKeysRequest      = "hostkeys-00@openssh.com"
+	hostKeysProveRequest = "hostkeys-prove-00@openssh.com"
+)
+
+// hostKey is a host key and, when a CA is configured, its certificate.
+type hostKey struct {
+	signer     gossh.Signer
+	cert       *gossh.Certificate
+	certSigner gossh.Signer
+	created    time.Time
+}
+
+// HostKeyManager generates and rotates the server's host keys. Keys are
+// stored in Dir as `ssh_host_<type>_key`. With RotateEvery set, a
+// replacement key is generated Overlap before the rotation and announced to
+// clients with the `hostkeys-00@openssh.com` extension so OpenSSH clients
+// (UpdateHostKeys) learn it before it is used.
+type HostKeyManager struct {
+	Dir    string
+	Types  []string
+	Logger *slog.Logger
+	// RotateEvery is the lifetime of a host key, 0 disables rotation.
+	RotateEvery time.Duration
+	// Overlap is how long the next key is announced before it replaces the
+	// current one, defaults to a quarter of RotateEvery.
+	Overlap time.Duration
+	// CA signs host certificates for the keys when set.
+	CA             gossh.Signer
+	CertPrincipals []string
+	// CertValidity defaults to 30 days, certificates are renewed when a
+	// quarter of it is left.
+	CertValidity time.Duration
+
+	mu      sync.RWMutex
+	current map[string]*hostKey
+	next    map[string]*hostKey
+	servers []*ssh.Server
+
+	exchangesMu sync.Mutex
+	exchanges   map[string]signedExchange
+}
+
+// signedExchange is the host key algorithm an exchange hash was signed with.
+type signedExchange struct {
+	algorithm string
+	at        time.Time
+}
+
+// NewHostKeyManager loads the host keys of the given types (ed25519, ecdsa
+// and rsa by default) from dir, generating the ones that are missing.
+func NewHostKeyManager(dir string, logger *slog.Logger, types ...string) (*HostKeyManager, error) {
+	if len(types) == 0 {
+		types = []string{HostKeyEd25519, HostKeyECDSA, HostKeyRSA}
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &HostKeyManager{
+		Dir:       dir,
+		Types:     types,
+		Logger:    logger,
+		current:   map[string]*hostKey{},
+		next:      map[string]*hostKey{},
+		exchanges: map[string]signedExchange{},
+	}
+
+	for _, keyType := range types {
+		key, err := m.loadKey(m.keyPath(keyType))
+		if errors.Is(err, os.ErrNotExist) {
+			key, err = m.generateKey(keyType, m.keyPath(keyType))
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.current[keyType] = key
+
+		next, err := m.loadKey(m.nextKeyPath(keyType))
+		if err == nil {
+			m.next[keyType] = next
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+func (m *HostKeyManager) keyPath(keyType string) string {
+	return filepath.Join(m.Dir, fmt.Sprintf("ssh_host_%s_key", keyType))
+}
+
+func (m *HostKeyManager) nextKeyPath(keyType string) string {
+	return m.keyPath(keyType) + ".next"
+}
+
+func (m *HostKeyManager) loadKey(path string) (*hostKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := gossh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &hostKey{signer: signer, created: info.ModTime()}, nil
+}
+
+func (m *HostKeyManager) generateKey(keyType string, path string) (*hostKey, error) {
+	var key crypto.Signer
+	var err error
+	switch keyType {
+	case HostKeyEd25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case HostKeyECDSA:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case HostKeyRSA:
+		key, err = rsa.GenerateKey(rand.Reader, 3072)
+	default:
+		return nil, fmt.Errorf("unsupported host key type %q", keyType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := gossh.MarshalPrivateKey(key, "tunkit host key")
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := gossh.NewSignerFromSigner(key)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Logger.Info(
+		"generated host key",
+		"path", path,
+		"fingerprint", gossh.FingerprintSHA256(signer.PublicKey()),
+	)
+	return &hostKey{signer: signer, created: time.Now()}, nil
+}
+
+func (m *HostKeyManager) signCert(key *hostKey) error {
+	validity := m.CertValidity
+	if validity == 0 {
+		validity = 30 * 24 * time.Hour
+	}
+
+	var serial [8]byte
+	_, err := io.ReadFull(rand.Reader, serial[:])
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	cert := &gossh.Certificate{
+		Key:             key.signer.PublicKey(),
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        gossh.HostCert,
+		KeyId:           "tunkit host key",
+		ValidPrincipals: m.CertPrincipals,
+		ValidAfter:      uint64(now.Add(-5 * time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(validity).Unix()),
+	}
+	err = cert.SignCert(rand.Reader, m.CA)
+	if err != nil {
+		return err
+	}
+	certSigner, err := gossh.NewCertSigner(cert, key.signer)
+	if err != nil {
+		return err
+	}
+	key.cert = cert
+	key.certSigner = certSigner
+	return nil
+}
+
+func (m *HostKeyManager) certExpiring(key *hostKey) bool {
+	if key.cert == nil {
+		return true
+	}
+	validBefore := time.Unix(int64(key.cert.ValidBefore), 0)
+	validAfter := time.Unix(int64(key.cert.ValidAfter), 0)
+	return time.Until(validBefore) < validBefore.Sub(validAfter)/4
+}
+
+// Rotate generates and promotes keys that are due and renews expiring
+// certificates. Watch calls it periodically.
+func (m *HostKeyManager) Rotate() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	overlap := m.Overlap
+	if overlap == 0 {
+		overlap = m.RotateEvery / 4
+	}
+
+	for _, keyType := range m.Types {
+		current := m.current[keyType]
+		age := time.Since(current.created)
+
+		if m.RotateEvery > 0 && m.next[keyType] == nil && age >= m.RotateEvery-overlap {
+			next, err := m.generateKey(keyType, m.nextKeyPath(keyType))
+			if err != nil {
+				return err
+			}
+			m.next[keyType] = next
+		}
+
+		if m.RotateEvery > 0 && m.next[keyType] != nil && age >= m.RotateEvery {
+			err := os.Rename(m.nextKeyPath(keyType), m.keyPath(keyType))
+			if err != nil {
+				return err
+			}
+			now := time.Now()
+			// the key's lifetime starts when it is promoted
+			err = os.Chtimes(m.keyPath(keyType), now, now)
+			if err != nil {
+				return err
+			}
+
+			current = m.next[keyType]
+			current.created = now
+			m.current[keyType] = current
+			delete(m.next, keyType)
+			m.Logger.Info(
+				"rotated host key",
+				"type", keyType,
+				"fingerprint", gossh.FingerprintSHA256(current.signer.PublicKey()),
+			)
+		}
+
+		if m.CA != nil && m.certExpiring(current) {
+			err := m.signCert(current)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// replaced rather than changed in place so a handshake in progress
+	// keeps the key it started with
+	for _, serv := range m.servers {
+		for _, keyType := range m.Types {
+			key := m.current[keyType]
+			serv.AddHostKey(&hostKeySigner{key.signer.(gossh.AlgorithmSigner), m})
+			if key.certSigner != nil {
+				serv.AddHostKey(&hostKeySigner{key.certSigner.(gossh.AlgorithmSigner), m})
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *HostKeyManager) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := m.Rotate()
+			if err != nil {
+				m.Logger.Error("unable to rotate host keys", "err", err)
+			}
+		}
+	}
+}
+
+// PublicKeys returns the current and next host keys, the set announced to
+// clients.
+func (m *HostKeyManager) PublicKeys() []gossh.PublicKey {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := []gossh.PublicKey{}
+	for _, keyType := range m.Types {
+		keys = append(keys, m.current[keyType].signer.PublicKey())
+		if next := m.next[keyType]; next != nil {
+			keys = append(keys, next.signer.PublicKey())
+		}
+	}
+	return keys
+}
+
+// findSigner returns the current or next key matching blob.
+func (m *HostKeyManager) findSigner(blob []byte) gossh.Signer {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, keyType := range m.Types {
+		for _, key := range []*hostKey{m.current[keyType], m.next[keyType]} {
+			if key != nil && string(key.signer.PublicKey().Marshal()) == string(blob) {
+				return key.signer
+			}
+		}
+	}
+	return nil
+}
+
+// hostKeySigner signs with one host key and records the algorithm of every
+// exchange hash it signs. The hash of a connection's first key exchange is
+// its session ID.
+type hostKeySigner struct {
+	gossh.AlgorithmSigner
+	manager *HostKeyManager
+}
+
+func (s *hostKeySigner) Sign(rand io.Reader, data []byte) (*gossh.Signature, error) {
+	algorithm := s.PublicKey().Type()
+	if cert, ok := s.PublicKey().(*gossh.Certificate); ok {
+		algorithm = cert.Key.Type()
+	}
+	s.manager.signedExchange(data, algorithm)
+	return s.AlgorithmSigner.Sign(rand, data)
+}
+
+func (s *hostKeySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*gossh.Signature, error) {
+	s.manager.signedExchange(data, algorithm)
+	return s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+func (m *HostKeyManager) signedExchange(hash []byte, algorithm string) {
+	m.exchangesMu.Lock()
+	defer m.exchangesMu.Unlock()
+	// a connection claims its record with its first auth request, rekeys and
+	// handshakes that never get there are never looked up
+	for key, exchange := range m.exchanges {
+		if time.Since(exchange.at) > time.Minute {
+			delete(m.exchanges, key)
+		}
+	}
+	m.exchanges[string(hash)] = signedExchange{algorithm: algorithm, at: time.Now()}
+}
+
+// exchangeAlgorithm returns the host key algorithm negotiated for the
+// connection with sessionID.
+func (m *HostKeyManager) exchangeAlgorithm(sessionID []byte) string {
+	m.exchangesMu.Lock()
+	defer m.exchangesMu.Unlock()
+	exchange := m.exchanges[string(sessionID)]
+	delete(m.exchanges, string(sessionID))
+	return exchange.algorithm
+}
+
+type ctxHostKeyAlgorithmKey struct{}
+
+func getHostKeyAlgorithmCtx(ctx ssh.Context) string {
+	algorithm, _ := ctx.Value(ctxHostKeyAlgorithmKey{}).(string)
+	return algorithm
+}
+
+func setHostKeyAlgorithmCtx(ctx ssh.Context, algorithm string) {
+	ctx.SetValue(ctxHostKeyAlgorithmKey{}, algorithm)
+}
+
+type ctxHostKeysAnnounceKey struct{}
+
+// announce sends the host keys once per connection. It is called from the
+// connection's channel and request handlers, which only run once the
+// handshake completed.
+func (m *HostKeyManager) announce(ctx ssh.Context) {
+	once, ok := ctx.Value(ctxHostKeysAnnounceKey{}).(*sync.Once)
+	if !ok {
+		return
+	}
+	once.Do(func() {
+		conn, ok := ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+		if !ok {
+			return
+		}
+		payload := []byte{}
+		for _, key := range m.PublicKeys() {
+			payload = append(payload, gossh.Marshal(struct{ Blob []byte }{key.Marshal()})...)
+		}
+		_, _, err := conn.SendRequest(hostKeysRequest, false, payload)
+		if err != nil {
+			m.Logger.Error("unable to announce host keys", "err", err)
+		}
+	})
+}
+
+// announceHandlers wraps the server's channel and request handlers with
+// announce. The defaults it adds behave like the server without them.
+func (m *HostKeyManager) announceHandlers(srv *ssh.Server) {
+	if srv.ChannelHandlers == nil {
+		srv.ChannelHandlers = map[string]ssh.ChannelHandler{}
+		for name, handler := range ssh.DefaultChannelHandlers {
+			srv.ChannelHandlers[name] = handler
+		}
+	}
+	if srv.ChannelHandlers["default"] == nil {
+		srv.ChannelHandlers["default"] = func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+			_ = newChan.Reject(gossh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+	for name, handler := range srv.ChannelHandlers {
+		handler := handler
+		srv.ChannelHandlers[name] = func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+			m.announce(ctx)
+			handler(srv, conn, newChan, ctx)
+		}
+	}
+
+	if srv.RequestHandlers == nil {
+		srv.RequestHandlers = map[string]ssh.RequestHandler{}
+	}
+	if srv.RequestHandlers["default"] == nil {
+		srv.RequestHandlers["default"] = func(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+			return false, nil
+		}
+	}
+	for name, handler := range srv.RequestHandlers {
+		handler := handler
+		srv.RequestHandlers[name] = func(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+			m.announce(ctx)
+			return handler(ctx, srv, req)
+		}
+	}
+}
+
+// handleProve signs the keys the client asks about to prove we own them.
+func (m *HostKeyManager) handleProve(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	sessionID, err := hex.DecodeString(ctx.SessionID())
+	if err != nil {
+		return false, nil
+	}
+
+	payload := req.Payload
+	resp := []byte{}
+	for len(payload) > 0 {
+		var blob struct {
+			Blob []byte
+			Rest []byte `ssh:"rest"`
+		}
+		err := gossh.Unmarshal(payload, &blob)
+		if err != nil {
+			return false, nil
+		}
+		payload = blob.Rest
+
+		signer := m.findSigner(blob.Blob)
+		if signer == nil {
+			m.Logger.Error("client asked to prove unknown host key")
+			return false, nil
+		}
+
+		data := gossh.Marshal(struct {
+			Request   string
+			SessionID []byte
+			Blob      []byte
+		}{hostKeysProveRequest, sessionID, blob.Blob})
+
+		var sig *gossh.Signature
+		if signer.PublicKey().Type() == gossh.KeyAlgoRSA {
+			// OpenSSH clients verify RSA proofs with the algorithm of the
+			// handshake when it was an RSA one and accept any otherwise
+			algorithm := getHostKeyAlgorithmCtx(ctx)
+			switch algorithm {
+			case gossh.KeyAlgoRSA, gossh.KeyAlgoRSASHA256, gossh.KeyAlgoRSASHA512:
+			default:
+				algorithm = gossh.KeyAlgoRSASHA512
+			}
+			sig, err = signer.(gossh.AlgorithmSigner).SignWithAlgorithm(rand.Reader, data, algorithm)
+		} else {
+			sig, err = signer.Sign(rand.Reader, data)
+		}
+		if err != nil {
+			m.Logger.Error("unable to prove host key", "err", err)
+			return false, nil
+		}
+		resp = append(resp, gossh.Marshal(struct{ Sig []byte }{gossh.Marshal(sig)})...)
+	}
+
+	return true, resp
+}
+
+// WithHostKeyManager serves the manager's keys (and certificates) as host
+// keys, announces them to clients and answers their proofs.
+func WithHostKeyManager(m *HostKeyManager) ssh.Option {
+	return func(serv *ssh.Server) error {
+		m.mu.Lock()
+		m.servers = append(m.servers, serv)
+		m.mu.Unlock()
+		// adds the keys to serv
+		err := m.Rotate()
+		if err != nil {
+			return err
+		}
+
+		if serv.RequestHandlers == nil {
+			serv.RequestHandlers = map[string]ssh.RequestHandler{}
+		}
+		serv.RequestHandlers[hostKeysProveRequest] = m.handleProve
+
+		// the config is built for connections every ConnCallback accepted,
+		// after all options are applied and before any handler runs
+		var wrapOnce sync.Once
+		prev := serv.ServerConfigCallback
+		serv.ServerConfigCallback = func(ctx ssh.Context) *gossh.ServerConfig {
+			wrapOnce.Do(func() { m.announceHandlers(serv) })
+			ctx.SetValue(ctxHostKeysAnnounceKey{}, &sync.Once{})
+
+			config := &gossh.ServerConfig{}
+			if prev != nil {
+				config = prev(ctx)
+			}
+			// the first auth request arrives right after the key exchange,
+			// however long the authentication itself takes
+			authLog := config.AuthLogCallback
+			config.AuthLogCallback = func(conn gossh.ConnMetadata, method string, err error) {
+				if getHostKeyAlgorithmCtx(ctx) == "" {
+					setHostKeyAlgorithmCtx(ctx, m.exchangeAlgorithm(conn.SessionID()))
+				}
+				if authLog != nil {
+					authLog(conn, method, err)
+				}
+			}
+			return config
+		}
+		return nil
+	}
+}
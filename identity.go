@@ -0,0 +1,185 @@
+package tunkit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/charmbracelet/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Headers set on every request served through a WebTunnel when
+// `WebTunnelHandler.IdentityHeaders` is enabled. gRPC services see them as
+// lowercase metadata keys.
+var (
+	HeaderUser        = "Tunkit-User"
+	HeaderFingerprint = "Tunkit-Fingerprint"
+	HeaderSessionID   = "Tunkit-Session-Id"
+)
+
+// Environment variables set on processes started for a user, e.g. by
+// ExecTunnelHandler.
+var (
+	EnvUser        = "TUNKIT_USER"
+	EnvFingerprint = "TUNKIT_FINGERPRINT"
+	EnvPrincipals  = "TUNKIT_PRINCIPALS"
+	EnvSessionID   = "TUNKIT_SESSION_ID"
+	EnvRemoteAddr  = "TUNKIT_REMOTE_ADDR"
+)
+
+func getPubkeyCtx(ctx ssh.Context) (ssh.PublicKey, error) {
+	pubkey, ok := ctx.Value(ssh.ContextKeyPublicKey).(ssh.PublicKey)
+	if pubkey == nil || !ok {
+		return pubkey, fmt.Errorf("pubkey not set on `ssh.Context()` for connection")
+	}
+	return pubkey, nil
+}
+
+// GetFingerprint returns the SHA256 fingerprint of the public key the user
+// authenticated with or an empty string when there is none.
+func GetFingerprint(ctx ssh.Context) string {
+	pubkey, err := getPubkeyCtx(ctx)
+	if err != nil {
+		return ""
+	}
+	return gossh.FingerprintSHA256(pubkey)
+}
+
+// GetPrincipals returns the principals of the certificate the user
+// authenticated with when it was signed by a CA trusted with WithUserCAs,
+// nil otherwise. Anyone can self-sign a certificate so the principals of
+// unverified ones are never returned.
+func GetPrincipals(ctx ssh.Context) []string {
+	pubkey, err := getPubkeyCtx(ctx)
+	if err != nil {
+		return nil
+	}
+	cert, ok := pubkey.(*gossh.Certificate)
+	if !ok {
+		return nil
+	}
+	verified, _ := ctx.Value(ctxVerifiedCertKey{}).([]byte)
+	if !bytes.Equal(verified, cert.Marshal()) {
+		return nil
+	}
+	return cert.ValidPrincipals
+}
+
+type ctxVerifiedCertKey struct{}
+
+// verifyUserCert checks that cert is a user certificate signed by one of
+// the authorities and currently valid. Principals are used as groups, not
+// login names, so the user name is not required to be one of them.
+func verifyUserCert(authorities []gossh.PublicKey, cert *gossh.Certificate) error {
+	if cert.CertType != gossh.UserCert {
+		return fmt.Errorf("certificate is not a user certificate")
+	}
+	trusted := slices.ContainsFunc(authorities, func(ca gossh.PublicKey) bool {
+		return bytes.Equal(ca.Marshal(), cert.SignatureKey.Marshal())
+	})
+	if !trusted {
+		return fmt.Errorf("certificate signed by unknown authority")
+	}
+	// CheckCert verifies the signature, validity window and critical options
+	checker := &gossh.CertChecker{}
+	principal := ""
+	if len(cert.ValidPrincipals) > 0 {
+		principal = cert.ValidPrincipals[0]
+	}
+	return checker.CheckCert(principal, cert)
+}
+
+// WithUserCAs trusts user certificates signed by authorities: they are
+// accepted for login and their principals are returned by GetPrincipals.
+// Without it certificate principals are ignored. It wraps the server's
+// PublicKeyHandler so it must come after `wish.WithAuthorizedKeys` or
+// `wish.WithPublicKeyAuth` when those are used.
+func WithUserCAs(logger *slog.Logger, authorities ...gossh.PublicKey) ssh.Option {
+	return func(serv *ssh.Server) error {
+		prev := serv.PublicKeyHandler
+		serv.PublicKeyHandler = func(ctx ssh.Context, key ssh.PublicKey) bool {
+			if cert, ok := key.(*gossh.Certificate); ok {
+				err := verifyUserCert(authorities, cert)
+				if err == nil {
+					ctx.SetValue(ctxVerifiedCertKey{}, cert.Marshal())
+					return true
+				}
+				logger.Info(
+					"rejected user certificate",
+					"user", ctx.User(),
+					"keyID", cert.KeyId,
+					"remoteAddr", ctx.RemoteAddr().String(),
+					"err", err,
+				)
+				return false
+			}
+			if prev == nil {
+				return false
+			}
+			return prev(ctx, key)
+		}
+		return nil
+	}
+}
+
+// getKeyFingerprints returns the fingerprint of the key the user
+// authenticated with and, for certificates, the fingerprint of the
+// certified key as well.
+func getKeyFingerprints(ctx ssh.Context) []string {
+	pubkey, err := getPubkeyCtx(ctx)
+	if err != nil {
+		return nil
+	}
+	fingerprints := []string{gossh.FingerprintSHA256(pubkey)}
+	if cert, ok := pubkey.(*gossh.Certificate); ok {
+		fingerprints = append(fingerprints, gossh.FingerprintSHA256(cert.Key))
+	}
+	return fingerprints
+}
+
+// identityEnv returns the user's identity as environment variables,
+// principals are comma separated.
+func identityEnv(ctx ssh.Context) []string {
+	return []string{
+		EnvUser + "=" + ctx.User(),
+		EnvFingerprint + "=" + GetFingerprint(ctx),
+		EnvPrincipals + "=" + strings.Join(GetPrincipals(ctx), ","),
+	}
+}
+
+type ctxSshKey struct{}
+
+func withSshCtx(parent context.Context, ctx ssh.Context) context.Context {
+	return context.WithValue(parent, ctxSshKey{}, ctx)
+}
+
+// GetSshCtx returns the SSH context of the tunnel a request (or gRPC call)
+// was received on.
+func GetSshCtx(ctx context.Context) (ssh.Context, error) {
+	sshCtx, ok := ctx.Value(ctxSshKey{}).(ssh.Context)
+	if sshCtx == nil || !ok {
+		return nil, fmt.Errorf("ssh context not set on `context.Context` for request")
+	}
+	return sshCtx, nil
+}
+
+// GetRequestSshCtx returns the SSH context of the tunnel the request was
+// received on.
+func GetRequestSshCtx(r *http.Request) (ssh.Context, error) {
+	return GetSshCtx(r.Context())
+}
+
+func identityHeaders(ctx ssh.Context, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// never trust identity headers sent by the client
+		r.Header.Set(HeaderUser, ctx.User())
+		r.Header.Set(HeaderFingerprint, GetFingerprint(ctx))
+		r.Header.Set(HeaderSessionID, ctx.SessionID())
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,89 @@
+package tunkit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) gossh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestVerifyUserCert(t *testing.T) {
+	ca := newTestSigner(t)
+	other := newTestSigner(t)
+	user := newTestSigner(t)
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		signer   gossh.Signer
+		certType uint32
+		after    time.Time
+		before   time.Time
+		wantErr  bool
+	}{
+		{"trusted", ca, gossh.UserCert, now.Add(-time.Hour), now.Add(time.Hour), false},
+		{"self-signed", user, gossh.UserCert, now.Add(-time.Hour), now.Add(time.Hour), true},
+		{"untrusted ca", other, gossh.UserCert, now.Add(-time.Hour), now.Add(time.Hour), true},
+		{"host cert", ca, gossh.HostCert, now.Add(-time.Hour), now.Add(time.Hour), true},
+		{"expired", ca, gossh.UserCert, now.Add(-2 * time.Hour), now.Add(-time.Hour), true},
+		{"not yet valid", ca, gossh.UserCert, now.Add(time.Hour), now.Add(2 * time.Hour), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := &gossh.Certificate{
+				Key:             user.PublicKey(),
+				CertType:        tt.certType,
+				ValidPrincipals: []string{"admin"},
+				ValidAfter:      uint64(tt.after.Unix()),
+				ValidBefore:     uint64(tt.before.Unix()),
+			}
+			err := cert.SignCert(rand.Reader, tt.signer)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = verifyUserCert([]gossh.PublicKey{ca.PublicKey()}, cert)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyUserCert() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyUserCertForgedAuthority(t *testing.T) {
+	ca := newTestSigner(t)
+	user := newTestSigner(t)
+	cert := &gossh.Certificate{
+		Key:             user.PublicKey(),
+		CertType:        gossh.UserCert,
+		ValidPrincipals: []string{"admin"},
+		ValidBefore:     gossh.CertTimeInfinity,
+	}
+	err := cert.SignCert(rand.Reader, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// claim the trusted CA signed it
+	cert.SignatureKey = ca.PublicKey()
+
+	err = verifyUserCert([]gossh.PublicKey{ca.PublicKey()}, cert)
+	if err == nil {
+		t.Error("verifyUserCert() accepted a certificate with a forged authority")
+	}
+}
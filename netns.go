@@ -0,0 +1,68 @@
+package tunkit
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var ErrNetNamespaceUnsupported = errors.New("network namespaces are only supported on linux")
+
+// NetNamespace is an anonymous network namespace with only a loopback
+// interface. It is not mounted anywhere, so only the process holding it can
+// listen and dial inside. Creating one requires CAP_SYS_ADMIN.
+type NetNamespace struct {
+	mu sync.Mutex
+	fd int
+}
+
+func NewNetNamespace() (*NetNamespace, error) {
+	fd, err := newNetNamespace()
+	if err != nil {
+		return nil, err
+	}
+	return &NetNamespace{fd: fd}, nil
+}
+
+func (ns *NetNamespace) Listen(network, addr string) (net.Listener, error) {
+	var ln net.Listener
+	err := ns.run(func() error {
+		var err error
+		ln, err = net.Listen(network, addr)
+		return err
+	})
+	return ln, err
+}
+
+func (ns *NetNamespace) Dial(network, addr string) (net.Conn, error) {
+	var conn net.Conn
+	err := ns.run(func() error {
+		var err error
+		conn, err = net.Dial(network, addr)
+		return err
+	})
+	return conn, err
+}
+
+func (ns *NetNamespace) run(fn func() error) error {
+	// held so Close cannot release the fd while it is in use
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.fd < 0 {
+		return net.ErrClosed
+	}
+	return runInNetNamespace(ns.fd, fn)
+}
+
+// Close releases the namespace, the kernel removes it once the sockets
+// created inside are closed as well.
+func (ns *NetNamespace) Close() error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.fd < 0 {
+		return nil
+	}
+	err := closeNetNamespace(ns.fd)
+	ns.fd = -1
+	return err
+}
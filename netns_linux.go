@@ -0,0 +1,91 @@
+//go:build linux
+
+package tunkit
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+const threadNetNamespace = "/proc/thread-self/ns/net"
+
+// onThread runs fn on a locked OS thread of a new goroutine and restores
+// the thread's network namespace afterwards. When that fails the thread
+// stays locked so it is thrown away with the goroutine.
+func onThread(fn func() error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		orig, err := unix.Open(threadNetNamespace, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			runtime.UnlockOSThread()
+			errCh <- err
+			return
+		}
+		defer unix.Close(orig)
+
+		fnErr := fn()
+		err = unix.Setns(orig, unix.CLONE_NEWNET)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		runtime.UnlockOSThread()
+		errCh <- fnErr
+	}()
+	return <-errCh
+}
+
+func newNetNamespace() (int, error) {
+	fd := -1
+	err := onThread(func() error {
+		err := unix.Unshare(unix.CLONE_NEWNET)
+		if err != nil {
+			return err
+		}
+		fd, err = unix.Open(threadNetNamespace, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		return loopbackUp()
+	})
+	if err != nil && fd >= 0 {
+		unix.Close(fd)
+		fd = -1
+	}
+	return fd, err
+}
+
+func loopbackUp() error {
+	sock, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(sock)
+
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	err = unix.IoctlIfreq(sock, unix.SIOCGIFFLAGS, ifr)
+	if err != nil {
+		return err
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	return unix.IoctlIfreq(sock, unix.SIOCSIFFLAGS, ifr)
+}
+
+func runInNetNamespace(fd int, fn func() error) error {
+	return onThread(func() error {
+		err := unix.Setns(fd, unix.CLONE_NEWNET)
+		if err != nil {
+			return err
+		}
+		return fn()
+	})
+}
+
+func closeNetNamespace(fd int) error {
+	return unix.Close(fd)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package tunkit
+
+func newNetNamespace() (int, error) {
+	return -1, ErrNetNamespaceUnsupported
+}
+
+func runInNetNamespace(fd int, fn func() error) error {
+	return ErrNetNamespaceUnsupported
+}
+
+func closeNetNamespace(fd int) error {
+	return nil
+}
@@ -0,0 +1,144 @@
+package tunkit
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+)
+
+var notifyHistory = 20
+
+// Event is a human-readable status or error meant for the user on the other
+// end of an SSH connection.
+type Event struct {
+	Time    time.Time
+	Level   slog.Level
+	Message string
+	Err     error
+}
+
+func (ev Event) String() string {
+	if ev.Err != nil {
+		return fmt.Sprintf("%s: %s", ev.Message, ev.Err)
+	}
+	return ev.Message
+}
+
+// notifier fans out the events of one SSH connection to its sessions.
+type notifier struct {
+	sync.Mutex
+	history     []Event
+	nextID      int
+	subscribers map[int]chan Event
+}
+
+type ctxNotifierKey struct{}
+
+func getNotifierCtx(ctx ssh.Context) *notifier {
+	ctx.Lock()
+	defer ctx.Unlock()
+	n, ok := ctx.Value(ctxNotifierKey{}).(*notifier)
+	if n == nil || !ok {
+		n = &notifier{subscribers: map[int]chan Event{}}
+		ctx.SetValue(ctxNotifierKey{}, n)
+	}
+	return n
+}
+
+// Notify sends an event to every session of the connection. Events sent
+// before a session is attached are replayed when it subscribes.
+func Notify(ctx ssh.Context, level slog.Level, msg string, err error) {
+	ev := Event{
+		Time:    time.Now(),
+		Level:   level,
+		Message: msg,
+		Err:     err,
+	}
+
+	n := getNotifierCtx(ctx)
+	n.Lock()
+	defer n.Unlock()
+	n.history = append(n.history, ev)
+	if len(n.history) > notifyHistory {
+		n.history = n.history[len(n.history)-notifyHistory:]
+	}
+	for _, sub := range n.subscribers {
+		select {
+		case sub <- ev:
+		default:
+			// never block a tunnel on a slow terminal
+		}
+	}
+}
+
+// SubscribeEvents returns the connection's past and future events. Call the
+// returned func to unsubscribe, which closes the channel.
+func SubscribeEvents(ctx ssh.Context) (<-chan Event, func()) {
+	n := getNotifierCtx(ctx)
+	n.Lock()
+	defer n.Unlock()
+
+	sub := make(chan Event, notifyHistory+16)
+	for _, ev := range n.history {
+		sub <- ev
+	}
+	n.nextID += 1
+	id := n.nextID
+	n.subscribers[id] = sub
+
+	return sub, func() {
+		n.Lock()
+		defer n.Unlock()
+		if _, ok := n.subscribers[id]; ok {
+			delete(n.subscribers, id)
+			close(sub)
+		}
+	}
+}
+
+type EventFormatter = func(ev Event) string
+
+func DefaultEventFormatter(ev Event) string {
+	return fmt.Sprintf("[tunkit] %s %s", ev.Level, ev)
+}
+
+// NotifyMiddleware writes the connection's events to the stderr of every
+// session using format (DefaultEventFormatter when nil).
+func NotifyMiddleware(format EventFormatter) wish.Middleware {
+	if format == nil {
+		format = DefaultEventFormatter
+	}
+
+	return func(next ssh.Handler) ssh.Handler {
+		return func(sesh ssh.Session) {
+			events, unsubscribe := SubscribeEvents(sesh.Context())
+			done := make(chan struct{})
+			defer func() {
+				unsubscribe()
+				close(done)
+			}()
+
+			go func() {
+				for {
+					select {
+					case ev, ok := <-events:
+						if !ok {
+							return
+						}
+						wish.Errorln(sesh, format(ev))
+					case <-done:
+						return
+					case <-sesh.Context().Done():
+						return
+					}
+				}
+			}()
+
+			next(sesh)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package tunkit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+	// longest v1 header including the CRLF
+	proxyV1MaxLen = 107
+
+	errProxyHeader = errors.New("invalid proxy protocol header")
+)
+
+// ProxyProtocolListener wraps the SSH listener of a server that runs behind
+// a TCP load balancer. Connections from Trusted networks must start with a
+// PROXY protocol v1 or v2 header and report the client address it contains
+// as their RemoteAddr, so `ssh.Context.RemoteAddr()`, logs and IP based
+// policies see the real client. Connections from anywhere else are passed
+// through untouched.
+//
+//	ln, _ := net.Listen("tcp", ":2222")
+//	pln, _ := tunkit.NewProxyProtocolListener(ln, []string{"10.0.0.0/8"}, logger)
+//	s.Serve(pln)
+type ProxyProtocolListener struct {
+	net.Listener
+	Trusted []*net.IPNet
+	Logger  *slog.Logger
+	// HeaderTimeout bounds how long we wait for the header, defaults to 5s.
+	HeaderTimeout time.Duration
+}
+
+// NewProxyProtocolListener trusts the given CIDRs or single IPs.
+func NewProxyProtocolListener(ln net.Listener, trusted []string, logger *slog.Logger) (*ProxyProtocolListener, error) {
+	nets := []*net.IPNet{}
+	for _, cidr := range trusted {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return &ProxyProtocolListener{
+		Listener: ln,
+		Trusted:  nets,
+		Logger:   logger,
+	}, nil
+}
+
+func (pl *ProxyProtocolListener) trusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range pl.Trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pl *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !pl.trusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	timeout := pl.HeaderTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	// the header is read lazily so a slow load balancer does not block the
+	// accept loop
+	return &proxyConn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		logger:  pl.Logger,
+		timeout: timeout,
+	}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	logger  *slog.Logger
+	timeout time.Duration
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer func() {
+			_ = c.Conn.SetReadDeadline(time.Time{})
+		}()
+
+		addr, err := readProxyHeader(c.reader)
+		if err != nil {
+			c.err = err
+			c.logger.Error(
+				"proxy protocol",
+				"err", err,
+				"remoteAddr", c.Conn.RemoteAddr().String(),
+			)
+			c.Conn.Close()
+			return
+		}
+		c.remoteAddr = addr
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader returns the client address of a v1 or v2 header or nil
+// when the load balancer connected on its own behalf (health checks).
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	prefix, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, proxyV1Prefix) {
+		return readProxyV1(r)
+	}
+
+	prefix, err = r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(prefix, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+
+	return nil, fmt.Errorf("%w: missing header from trusted proxy", errProxyHeader)
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line := []byte{}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLen {
+			return nil, fmt.Errorf("%w: v1 header too long", errProxyHeader)
+		}
+	}
+
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", errProxyHeader, line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("%w: %q", errProxyHeader, line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	verCmd := header[12]
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", errProxyHeader, verCmd>>4)
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	switch verCmd & 0xf {
+	case 0x0:
+		// LOCAL
+		return nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("%w: unsupported command %d", errProxyHeader, verCmd&0xf)
+	}
+
+	switch family {
+	case 0x11:
+		// TCP over IPv4
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("%w: short ipv4 address block", errProxyHeader)
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x21:
+		// TCP over IPv6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("%w: short ipv6 address block", errProxyHeader)
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	default:
+		// UNSPEC, UDP or unix sockets carry no client address we can use
+		return nil, nil
+	}
+}
@@ -0,0 +1,133 @@
+package tunkit
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+const sshBanner = "SSH-2.0-OpenSSH_9.6\r\n"
+
+// proxyV2 builds a v2 header, length is taken from payload.
+func proxyV2(verCmd, family byte, payload []byte) string {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, verCmd, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return string(append(header, payload...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{
+		192, 0, 2, 1, // source
+		10, 0, 0, 1, // destination
+		0x30, 0x39, // source port 12345
+		0x08, 0xae, // destination port 2222
+	}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	copy(ipv6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(ipv6[32:], 12345)
+	binary.BigEndian.PutUint16(ipv6[34:], 2222)
+
+	tests := []struct {
+		name     string
+		input    string
+		wantAddr string
+		wantErr  bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 10.0.0.1 12345 2222\r\n", "192.0.2.1:12345", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 12345 2222\r\n", "[2001:db8::1]:12345", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 unknown with addresses", "PROXY UNKNOWN ::1 ::1 1 2\r\n", "", false},
+		{"v1 bad protocol", "PROXY UDP4 192.0.2.1 10.0.0.1 12345 2222\r\n", "", true},
+		{"v1 missing port", "PROXY TCP4 192.0.2.1 10.0.0.1 12345\r\n", "", true},
+		{"v1 bad address", "PROXY TCP4 192.0.2 10.0.0.1 12345 2222\r\n", "", true},
+		{"v1 port out of range", "PROXY TCP4 192.0.2.1 10.0.0.1 65536 2222\r\n", "", true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n", "", true},
+		{"v1 truncated", "PROXY TCP4 192.0.2.1 10.0", "", true},
+		{"v2 ipv4", proxyV2(0x21, 0x11, ipv4), "192.0.2.1:12345", false},
+		{"v2 ipv6", proxyV2(0x21, 0x21, ipv6), "[2001:db8::1]:12345", false},
+		{"v2 ipv4 with tlvs", proxyV2(0x21, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0x00)), "192.0.2.1:12345", false},
+		{"v2 local", proxyV2(0x20, 0x00, nil), "", false},
+		{"v2 unix", proxyV2(0x21, 0x31, make([]byte, 216)), "", false},
+		{"v2 bad version", proxyV2(0x11, 0x11, ipv4), "", true},
+		{"v2 bad command", proxyV2(0x22, 0x11, ipv4), "", true},
+		{"v2 short ipv4", proxyV2(0x21, 0x11, ipv4[:6]), "", true},
+		{"v2 short ipv6", proxyV2(0x21, 0x21, ipv6[:20]), "", true},
+		{"v2 truncated payload", proxyV2(0x21, 0x11, ipv4)[:20], "", true},
+		{"v2 truncated header", string(proxyV2Signature) + "\x21", "", true},
+		{"no header", sshBanner, "", true},
+		{"empty", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the SSH banner must be left to the server, malformed headers
+			// are read on their own so the banner cannot complete them
+			input := tt.input
+			if !tt.wantErr {
+				input += sshBanner
+			}
+			r := bufio.NewReader(strings.NewReader(input))
+
+			addr, err := readProxyHeader(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readProxyHeader() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.wantAddr {
+				t.Errorf("readProxyHeader() addr = %q, want %q", got, tt.wantAddr)
+			}
+
+			rest, _ := io.ReadAll(r)
+			if string(rest) != sshBanner {
+				t.Errorf("readProxyHeader() left %q, want %q", rest, sshBanner)
+			}
+		})
+	}
+}
+
+func TestNewProxyProtocolListener(t *testing.T) {
+	tests := []struct {
+		trusted []string
+		addr    string
+		want    bool
+		wantErr bool
+	}{
+		{[]string{"10.0.0.0/8"}, "10.1.2.3:1234", true, false},
+		{[]string{"10.0.0.0/8"}, "192.0.2.1:1234", false, false},
+		{[]string{"192.0.2.1"}, "192.0.2.1:1234", true, false},
+		{[]string{"192.0.2.1"}, "192.0.2.2:1234", false, false},
+		{[]string{"::1"}, "[::1]:1234", true, false},
+		{[]string{"10.0.0.0/33"}, "", false, true},
+		{[]string{"not an ip"}, "", false, true},
+	}
+
+	for _, tt := range tests {
+		pl, err := NewProxyProtocolListener(nil, tt.trusted, nil)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewProxyProtocolListener(%q) err = %v, wantErr %v", tt.trusted, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		addr, err := net.ResolveTCPAddr("tcp", tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pl.trusted(addr); got != tt.want {
+			t.Errorf("trusted(%s) with %q = %v, want %v", tt.addr, tt.trusted, got, tt.want)
+		}
+	}
+}
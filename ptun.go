@@ -2,10 +2,12 @@ package tunkit
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/charmbracelet/ssh"
 	gossh "golang.org/x/crypto/ssh"
@@ -30,7 +32,7 @@ func WithTunnel(handler Tunnel) ssh.Option {
 	return func(serv *ssh.Server) error {
 		if serv.ChannelHandlers == nil {
 			serv.ChannelHandlers = map[string]ssh.ChannelHandler{
-				"session": ssh.DefaultSessionHandler,
+				"session": sessionHandler,
 			}
 		}
 		serv.ChannelHandlers["direct-tcpip"] = localForwardHandler(handler)
@@ -56,54 +58,55 @@ func localForwardHandler(handler Tunnel) LocalForwardFn {
 			"port", check.Port,
 			"origAddr", check.OriginAddr,
 			"origPort", check.OriginPort,
+			"user", ctx.User(),
+			"fingerprint", GetFingerprint(ctx),
+			"sessionID", ctx.SessionID(),
 		)
 		log.Info("local forward request")
 
+		// connect before accepting so we can reject the channel with a
+		// reason the user's ssh client displays
+		downConn, err := handler.CreateConn(ctx)
+		if err != nil {
+			log.Error("unable to connect to conn", "err", err)
+			Notify(
+				ctx,
+				slog.LevelError,
+				fmt.Sprintf("local forward to %s:%d failed", check.Addr, check.Port),
+				err,
+			)
+			err = newChan.Reject(gossh.ConnectionFailed, err.Error())
+			if err != nil {
+				log.Error("cannot reject new channel", "err", err)
+			}
+			return
+		}
+
 		ch, reqs, err := newChan.Accept()
 		if err != nil {
 			log.Error("cannot accept new channel", "err", err)
+			downConn.Close()
 			return
 		}
-		go gossh.DiscardRequests(reqs)
+		go func() {
+			gossh.DiscardRequests(reqs)
+			// requests end when the channel is closed. bridgeConn only
+			// half-closes conns with CloseWrite on the client's EOF, so
+			// without this a conn whose peer never answers would keep its
+			// read, and an exec tunnel its process, alive after the client
+			// went away. Applies to every tunnel, closing twice is harmless.
+			downConn.Close()
+		}()
 
+		forward := &LocalForward{
+			Addr:       check.Addr,
+			Port:       check.Port,
+			OriginAddr: check.OriginAddr,
+			OriginPort: check.OriginPort,
+		}
 		go func() {
-			downConn, err := handler.CreateConn(ctx)
-			if err != nil {
-				log.Error("unable to connect to conn", "err", err)
-				ch.Close()
-				return
-			}
-			defer downConn.Close()
-
-			var wg sync.WaitGroup
-			wg.Add(2)
-
-			go func() {
-				defer wg.Done()
-				defer func() {
-					_ = ch.CloseWrite()
-				}()
-				defer downConn.Close()
-				_, err := io.Copy(ch, downConn)
-				if err != nil {
-					if !errors.Is(err, net.ErrClosed) {
-						log.Error("io copy", "err", err)
-					}
-				}
-			}()
-			go func() {
-				defer wg.Done()
-				defer ch.Close()
-				defer downConn.Close()
-				_, err := io.Copy(downConn, ch)
-				if err != nil {
-					if !errors.Is(err, net.ErrClosed) {
-						log.Error("io copy", "err", err)
-					}
-				}
-			}()
-
-			wg.Wait()
+			_ = bridgeConn(ctx, log, ch, downConn, forward)
+			ch.Close()
 		}()
 
 		err = conn.Wait()
@@ -116,3 +119,63 @@ func localForwardHandler(handler Tunnel) LocalForwardFn {
 		}
 	}
 }
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// bridgeConn copies between an accepted channel and the tunnel's conn,
+// tracking the pair as a LocalForward, until both directions are done. The
+// caller closes ch so it can send an exit status first, the returned error
+// is the first failed copy.
+func bridgeConn(ctx ssh.Context, log *slog.Logger, ch gossh.Channel, downConn net.Conn, forward *LocalForward) error {
+	forward.Start = time.Now()
+	forward.close = func() error {
+		downConn.Close()
+		return ch.Close()
+	}
+	removeForward := addLocalForward(ctx, forward)
+	defer removeForward()
+	defer downConn.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	errs := make([]error, 2)
+
+	go func() {
+		defer wg.Done()
+		defer func() {
+			_ = ch.CloseWrite()
+		}()
+		defer downConn.Close()
+		_, err := io.Copy(&countingWriter{ch, &forward.BytesOut}, downConn)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error("io copy", "err", err)
+				errs[0] = err
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(&countingWriter{downConn, &forward.BytesIn}, ch)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error("io copy", "err", err)
+				errs[1] = err
+			}
+		}
+		// let the tunnel finish its response when the user is done sending.
+		// For direct-tcpip this means an EOF from the client half-closes the
+		// tunnel conn instead of tearing down the whole forward.
+		if cw, ok := downConn.(closeWriter); ok && err == nil && cw.CloseWrite() == nil {
+			return
+		}
+		// ends the copy above, ch is left to the caller so a session still
+		// gets its exit status
+		downConn.Close()
+	}()
+
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -2,6 +2,7 @@ package tunkit
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
@@ -35,8 +36,22 @@ type remoteForwardChannelData struct {
 }
 
 type RemoteForwards struct {
-	Listener net.Listener
-	Pubkey   ssh.PublicKey
+	Listener  net.Listener
+	Pubkey    ssh.PublicKey
+	SessionID string
+	// Namespace is the network namespace Listener is bound in when the
+	// handler isolates keys.
+	Namespace *NetNamespace
+}
+
+// Dial connects to the remote forward, inside its network namespace when
+// there is one.
+func (rf *RemoteForwards) Dial() (net.Conn, error) {
+	addr := rf.Listener.Addr()
+	if rf.Namespace != nil {
+		return rf.Namespace.Dial(addr.Network(), addr.String())
+	}
+	return net.Dial(addr.Network(), addr.String())
 }
 
 // PubSubHandler can be enabled by creating a PubSubHandler and
@@ -44,8 +59,19 @@ type RemoteForwards struct {
 // tcpip-forward and cancel-tcpip-forward.
 type PubSubHandler struct {
 	Logger *slog.Logger
+	// IsolateKeys binds the remote forwards of each key in its own network
+	// namespace so users cannot reach each other's forwards or the host's
+	// services, use RemoteForwards.Dial to connect. The namespace is removed
+	// when the key's last connection ends. Linux only, needs CAP_SYS_ADMIN.
+	IsolateKeys bool
 	sync.Mutex
-	forwards map[string]*RemoteForwards
+	forwards   map[string]*RemoteForwards
+	namespaces map[string]*keyNamespace
+}
+
+type keyNamespace struct {
+	ns    *NetNamespace
+	conns int
 }
 
 func NewPubSubHandler(logger *slog.Logger) *PubSubHandler {
@@ -56,7 +82,69 @@ func NewPubSubHandler(logger *slog.Logger) *PubSubHandler {
 
 var forwardedTCPChannelType = "forwarded-tcpip"
 
+type ctxNetNamespaceKey struct{}
+
+// getNetNamespaceCtx returns the network namespace of the connection's key,
+// creating it on the key's first connection.
+func (h *PubSubHandler) getNetNamespaceCtx(ctx ssh.Context) (*NetNamespace, error) {
+	ctx.Lock()
+	defer ctx.Unlock()
+	ns, ok := ctx.Value(ctxNetNamespaceKey{}).(*NetNamespace)
+	if ns != nil && ok {
+		return ns, nil
+	}
+
+	fingerprint := GetFingerprint(ctx)
+	if fingerprint == "" {
+		return nil, fmt.Errorf("isolating remote forwards requires public key authentication")
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	if h.namespaces == nil {
+		h.namespaces = map[string]*keyNamespace{}
+	}
+	kn, ok := h.namespaces[fingerprint]
+	if !ok {
+		ns, err := NewNetNamespace()
+		if err != nil {
+			return nil, err
+		}
+		kn = &keyNamespace{ns: ns}
+		h.namespaces[fingerprint] = kn
+		h.GetLogger().Info("created network namespace", "fingerprint", fingerprint)
+	}
+	kn.conns += 1
+	ctx.SetValue(ctxNetNamespaceKey{}, kn.ns)
+
+	go func() {
+		<-ctx.Done()
+		h.Lock()
+		defer h.Unlock()
+		kn.conns -= 1
+		if kn.conns > 0 {
+			return
+		}
+		delete(h.namespaces, fingerprint)
+		_ = kn.ns.Close()
+		h.GetLogger().Info("removed network namespace", "fingerprint", fingerprint)
+	}()
+
+	return kn.ns, nil
+}
+
+// forwardKey identifies a remote forward, with isolated keys the same
+// address can be bound once per key.
+func (h *PubSubHandler) forwardKey(ctx ssh.Context, addr string) string {
+	if h.IsolateKeys {
+		return GetFingerprint(ctx) + " " + addr
+	}
+	return addr
+}
+
 func (h *PubSubHandler) GetForwards() []*RemoteForwards {
+	h.Lock()
+	defer h.Unlock()
 	return maps.Values(h.forwards)
 }
 
@@ -65,6 +153,8 @@ func (h *PubSubHandler) GetLogger() *slog.Logger {
 }
 
 func (h *PubSubHandler) GetForwardsByPubkey(pubkey ssh.PublicKey) []net.Listener {
+	h.Lock()
+	defer h.Unlock()
 	list := []net.Listener{}
 	for _, v := range h.forwards {
 		if bytes.Equal(v.Pubkey.Marshal(), pubkey.Marshal()) {
@@ -90,25 +180,40 @@ func (h *PubSubHandler) HandleRequest(ctx ssh.Context, srv *ssh.Server, req *gos
 			return false, []byte{}
 		}
 		addr := net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(int(reqPayload.BindPort)))
-		ln, err := net.Listen("tcp", addr)
+		var ns *NetNamespace
+		var ln net.Listener
+		var err error
+		if h.IsolateKeys {
+			ns, err = h.getNetNamespaceCtx(ctx)
+			if err == nil {
+				ln, err = ns.Listen("tcp", addr)
+			}
+		} else {
+			ln, err = net.Listen("tcp", addr)
+		}
 		if err != nil {
 			logger.Error("failed create net listener", "err", err)
+			Notify(ctx, slog.LevelError, fmt.Sprintf("remote forward on %s failed", addr), err)
 			return false, []byte{}
 		}
 		_, destPortStr, _ := net.SplitHostPort(ln.Addr().String())
 		destPort, _ := strconv.Atoi(destPortStr)
+		Notify(ctx, slog.LevelInfo, fmt.Sprintf("remote forward listening on %s", ln.Addr()), nil)
 		pubkey, _ := ctx.Value(ssh.ContextKeyPublicKey).(ssh.PublicKey)
 		remoteForward := RemoteForwards{
-			Listener: ln,
-			Pubkey:   pubkey,
+			Listener:  ln,
+			Pubkey:    pubkey,
+			SessionID: ctx.SessionID(),
+			Namespace: ns,
 		}
+		key := h.forwardKey(ctx, addr)
 		h.Lock()
-		h.forwards[addr] = &remoteForward
+		h.forwards[key] = &remoteForward
 		h.Unlock()
 		go func() {
 			<-ctx.Done()
 			h.Lock()
-			rf, ok := h.forwards[addr]
+			rf, ok := h.forwards[key]
 			h.Unlock()
 			if ok {
 				rf.Listener.Close()
@@ -149,7 +254,7 @@ func (h *PubSubHandler) HandleRequest(ctx ssh.Context, srv *ssh.Server, req *gos
 				}()
 			}
 			h.Lock()
-			delete(h.forwards, addr)
+			delete(h.forwards, key)
 			h.Unlock()
 		}()
 		return true, gossh.Marshal(&remoteForwardSuccess{uint32(destPort)})
@@ -162,7 +267,7 @@ func (h *PubSubHandler) HandleRequest(ctx ssh.Context, srv *ssh.Server, req *gos
 		}
 		addr := net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(int(reqPayload.BindPort)))
 		h.Lock()
-		rf, ok := h.forwards[addr]
+		rf, ok := h.forwards[h.forwardKey(ctx, addr)]
 		h.Unlock()
 		if ok {
 			rf.Listener.Close()
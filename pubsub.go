@@ -15,10 +15,11 @@ type PubSub interface {
 
 func WithPubSub(handler PubSub) ssh.Option {
 	return func(serv *ssh.Server) error {
-		serv.RequestHandlers = map[string]ssh.RequestHandler{
-			"tcpip-forward":        handler.HandleRequest,
-			"cancel-tcpip-forward": handler.HandleRequest,
+		if serv.RequestHandlers == nil {
+			serv.RequestHandlers = map[string]ssh.RequestHandler{}
 		}
+		serv.RequestHandlers["tcpip-forward"] = handler.HandleRequest
+		serv.RequestHandlers["cancel-tcpip-forward"] = handler.HandleRequest
 		return nil
 	}
 }
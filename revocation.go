@@ -0,0 +1,519 @@
+package tunkit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+var krlMagic = []byte("SSHKRL\n\x00")
+
+const (
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+
+	krlCertSerialList   = 0x20
+	krlCertSerialRange  = 0x21
+	krlCertSerialBitmap = 0x22
+	krlCertKeyID        = 0x23
+)
+
+var errKRLFormat = errors.New("invalid key revocation list")
+
+// certRevocations are the revoked certificates of one CA.
+type certRevocations struct {
+	serials map[uint64]bool
+	ranges  [][2]uint64
+	keyIDs  map[string]bool
+}
+
+func newCertRevocations() *certRevocations {
+	return &certRevocations{
+		serials: map[uint64]bool{},
+		keyIDs:  map[string]bool{},
+	}
+}
+
+func (cr *certRevocations) revoked(cert *gossh.Certificate) bool {
+	if cr.serials[cert.Serial] || cr.keyIDs[cert.KeyId] {
+		return true
+	}
+	for _, r := range cr.ranges {
+		if cert.Serial >= r[0] && cert.Serial <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// revocations is the parsed content of a KRL or fingerprint file.
+type revocations struct {
+	// SHA256 fingerprints in the format of gossh.FingerprintSHA256
+	fingerprints map[string]bool
+	sha1         map[string]bool
+	// keyed by the marshaled CA key, "" applies to any CA
+	certs map[string]*certRevocations
+}
+
+func newRevocations() *revocations {
+	return &revocations{
+		fingerprints: map[string]bool{},
+		sha1:         map[string]bool{},
+		certs:        map[string]*certRevocations{},
+	}
+}
+
+func (r *revocations) keyRevoked(key gossh.PublicKey) bool {
+	if r.fingerprints[gossh.FingerprintSHA256(key)] {
+		return true
+	}
+	sum := sha1.Sum(key.Marshal())
+	return r.sha1[string(sum[:])]
+}
+
+func (r *revocations) revoked(key gossh.PublicKey) bool {
+	if r.keyRevoked(key) {
+		return true
+	}
+
+	cert, ok := key.(*gossh.Certificate)
+	if !ok {
+		return false
+	}
+	if r.keyRevoked(cert.Key) || r.keyRevoked(cert.SignatureKey) {
+		return true
+	}
+	for _, ca := range []string{string(cert.SignatureKey.Marshal()), ""} {
+		if cr, ok := r.certs[ca]; ok && cr.revoked(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+type krlReader struct {
+	data []byte
+}
+
+func (kr *krlReader) uint64() (uint64, error) {
+	if len(kr.data) < 8 {
+		return 0, errKRLFormat
+	}
+	v := binary.BigEndian.Uint64(kr.data)
+	kr.data = kr.data[8:]
+	return v, nil
+}
+
+func (kr *krlReader) uint32() (uint32, error) {
+	if len(kr.data) < 4 {
+		return 0, errKRLFormat
+	}
+	v := binary.BigEndian.Uint32(kr.data)
+	kr.data = kr.data[4:]
+	return v, nil
+}
+
+func (kr *krlReader) byte() (byte, error) {
+	if len(kr.data) < 1 {
+		return 0, errKRLFormat
+	}
+	v := kr.data[0]
+	kr.data = kr.data[1:]
+	return v, nil
+}
+
+func (kr *krlReader) string() ([]byte, error) {
+	n, err := kr.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(kr.data)) < n {
+		return nil, errKRLFormat
+	}
+	v := kr.data[:n]
+	kr.data = kr.data[n:]
+	return v, nil
+}
+
+// parseKRL parses the binary OpenSSH KRL format described in PROTOCOL.krl.
+// Signature sections are not verified, everything after them is ignored.
+func parseKRL(data []byte) (*revocations, error) {
+	if !bytes.HasPrefix(data, krlMagic) {
+		return nil, errKRLFormat
+	}
+	kr := &krlReader{data: data[len(krlMagic):]}
+
+	version, err := kr.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if version != 1 {
+		return nil, fmt.Errorf("%w: unsupported format version %d", errKRLFormat, version)
+	}
+	// krl_version, generated_date, flags
+	for i := 0; i < 3; i++ {
+		if _, err := kr.uint64(); err != nil {
+			return nil, err
+		}
+	}
+	// reserved, comment
+	for i := 0; i < 2; i++ {
+		if _, err := kr.string(); err != nil {
+			return nil, err
+		}
+	}
+
+	revs := newRevocations()
+	for len(kr.data) > 0 {
+		sectionType, err := kr.byte()
+		if err != nil {
+			return nil, err
+		}
+		section, err := kr.string()
+		if err != nil {
+			return nil, err
+		}
+		sr := &krlReader{data: section}
+
+		switch sectionType {
+		case krlSectionCertificates:
+			err = parseKRLCerts(sr, revs)
+		case krlSectionExplicitKey:
+			for len(sr.data) > 0 {
+				blob, err := sr.string()
+				if err != nil {
+					return nil, err
+				}
+				key, err := gossh.ParsePublicKey(blob)
+				if err != nil {
+					return nil, err
+				}
+				revs.fingerprints[gossh.FingerprintSHA256(key)] = true
+			}
+		case krlSectionFingerprintSHA1:
+			for len(sr.data) > 0 {
+				hash, err := sr.string()
+				if err != nil {
+					return nil, err
+				}
+				revs.sha1[string(hash)] = true
+			}
+		case krlSectionFingerprintSHA256:
+			for len(sr.data) > 0 {
+				hash, err := sr.string()
+				if err != nil {
+					return nil, err
+				}
+				revs.fingerprints["SHA256:"+base64.RawStdEncoding.EncodeToString(hash)] = true
+			}
+		case krlSectionSignature:
+			return revs, nil
+		default:
+			return nil, fmt.Errorf("%w: unknown section %d", errKRLFormat, sectionType)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return revs, nil
+}
+
+func parseKRLCerts(kr *krlReader, revs *revocations) error {
+	caKey, err := kr.string()
+	if err != nil {
+		return err
+	}
+	// reserved
+	if _, err := kr.string(); err != nil {
+		return err
+	}
+
+	cr, ok := revs.certs[string(caKey)]
+	if !ok {
+		cr = newCertRevocations()
+		revs.certs[string(caKey)] = cr
+	}
+
+	for len(kr.data) > 0 {
+		sectionType, err := kr.byte()
+		if err != nil {
+			return err
+		}
+		section, err := kr.string()
+		if err != nil {
+			return err
+		}
+		sr := &krlReader{data: section}
+
+		switch sectionType {
+		case krlCertSerialList:
+			for len(sr.data) > 0 {
+				serial, err := sr.uint64()
+				if err != nil {
+					return err
+				}
+				cr.serials[serial] = true
+			}
+		case krlCertSerialRange:
+			min, err := sr.uint64()
+			if err != nil {
+				return err
+			}
+			max, err := sr.uint64()
+			if err != nil {
+				return err
+			}
+			cr.ranges = append(cr.ranges, [2]uint64{min, max})
+		case krlCertSerialBitmap:
+			offset, err := sr.uint64()
+			if err != nil {
+				return err
+			}
+			bitmap, err := sr.string()
+			if err != nil {
+				return err
+			}
+			bits := new(big.Int).SetBytes(bitmap)
+			for i := 0; i < bits.BitLen(); i++ {
+				if bits.Bit(i) == 1 {
+					cr.serials[offset+uint64(i)] = true
+				}
+			}
+		case krlCertKeyID:
+			for len(sr.data) > 0 {
+				keyID, err := sr.string()
+				if err != nil {
+					return err
+				}
+				cr.keyIDs[string(keyID)] = true
+			}
+		default:
+			return fmt.Errorf("%w: unknown certificate section %d", errKRLFormat, sectionType)
+		}
+	}
+
+	return nil
+}
+
+// parseRevokedKeys parses one SHA256 fingerprint or authorized_keys style
+// public key per line, `#` starts a comment.
+func parseRevokedKeys(data []byte) (*revocations, error) {
+	revs := newRevocations()
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "SHA256:") {
+			revs.fingerprints[strings.Fields(line)[0]] = true
+			continue
+		}
+
+		key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("invalid revoked key %q: %w", line, err)
+		}
+		revs.fingerprints[gossh.FingerprintSHA256(key)] = true
+	}
+	return revs, scanner.Err()
+}
+
+// KeyRevocations rejects revoked keys and certificates at authentication and
+// tears down the tunnels of connections whose key gets revoked while they
+// are open. Path is either an OpenSSH KRL (`ssh-keygen -k`) or a text file
+// with one SHA256 fingerprint or public key per line.
+type KeyRevocations struct {
+	Path   string
+	Logger *slog.Logger
+
+	mu      sync.RWMutex
+	revs    *revocations
+	modTime time.Time
+
+	connMu sync.Mutex
+	conns  map[ssh.Context]struct{}
+}
+
+func NewKeyRevocations(path string, logger *slog.Logger) (*KeyRevocations, error) {
+	kr := &KeyRevocations{
+		Path:   path,
+		Logger: logger,
+		conns:  map[ssh.Context]struct{}{},
+	}
+	err := kr.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+func (kr *KeyRevocations) Reload() error {
+	info, err := os.Stat(kr.Path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(kr.Path)
+	if err != nil {
+		return err
+	}
+
+	var revs *revocations
+	if bytes.HasPrefix(data, krlMagic) {
+		revs, err = parseKRL(data)
+	} else {
+		revs, err = parseRevokedKeys(data)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", kr.Path, err)
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.revs = revs
+	kr.modTime = info.ModTime()
+	return nil
+}
+
+func (kr *KeyRevocations) IsRevoked(key ssh.PublicKey) bool {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.revs.revoked(key)
+}
+
+// Enforce closes the live connections that authenticated with a key that is
+// now revoked, which tears down their local forwards, remote forwards and
+// web tunnel servers.
+func (kr *KeyRevocations) Enforce() {
+	kr.connMu.Lock()
+	conns := []ssh.Context{}
+	for ctx := range kr.conns {
+		conns = append(conns, ctx)
+	}
+	kr.connMu.Unlock()
+
+	for _, ctx := range conns {
+		pubkey, err := getPubkeyCtx(ctx)
+		if err != nil || !kr.IsRevoked(pubkey) {
+			continue
+		}
+		conn, ok := ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+		if !ok || conn == nil {
+			continue
+		}
+
+		kr.Logger.Info(
+			"closing connection with revoked key",
+			"user", ctx.User(),
+			"fingerprint", GetFingerprint(ctx),
+			"sessionID", ctx.SessionID(),
+		)
+		_ = conn.Close()
+	}
+}
+
+// Watch reloads the file when it changes and re-checks live connections on
+// every tick, which also catches connections that authenticated while a
+// reload was in flight.
+func (kr *KeyRevocations) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			kr.reloadChanged()
+			kr.Enforce()
+		}
+	}
+}
+
+func (kr *KeyRevocations) reloadChanged() {
+	info, err := os.Stat(kr.Path)
+	if err != nil {
+		kr.Logger.Error("unable to stat key revocations", "path", kr.Path, "err", err)
+		return
+	}
+
+	kr.mu.RLock()
+	changed := !info.ModTime().Equal(kr.modTime)
+	kr.mu.RUnlock()
+	if !changed {
+		return
+	}
+
+	err = kr.Reload()
+	if err != nil {
+		kr.Logger.Error("unable to reload key revocations", "path", kr.Path, "err", err)
+		return
+	}
+	kr.Logger.Info("reloaded key revocations", "path", kr.Path)
+}
+
+// WithKeyRevocations rejects revoked keys and tracks live connections for
+// Enforce. It wraps the server's PublicKeyHandler so it must come after
+// `wish.WithPublicKeyAuth` or `wish.WithAuthorizedKeys`.
+func WithKeyRevocations(kr *KeyRevocations) ssh.Option {
+	return func(serv *ssh.Server) error {
+		auth := serv.PublicKeyHandler
+		if auth == nil {
+			return fmt.Errorf("key revocations require public key auth to be set up first")
+		}
+		serv.PublicKeyHandler = func(ctx ssh.Context, key ssh.PublicKey) bool {
+			if kr.IsRevoked(key) {
+				kr.Logger.Info(
+					"rejected revoked key",
+					"user", ctx.User(),
+					"fingerprint", gossh.FingerprintSHA256(key),
+					"remoteAddr", ctx.RemoteAddr().String(),
+				)
+				return false
+			}
+			return auth(ctx, key)
+		}
+
+		prev := serv.ConnCallback
+		serv.ConnCallback = func(ctx ssh.Context, conn net.Conn) net.Conn {
+			if prev != nil {
+				conn = prev(ctx, conn)
+				if conn == nil {
+					return nil
+				}
+			}
+
+			kr.connMu.Lock()
+			kr.conns[ctx] = struct{}{}
+			kr.connMu.Unlock()
+			go func() {
+				<-ctx.Done()
+				kr.connMu.Lock()
+				delete(kr.conns, ctx)
+				kr.connMu.Unlock()
+			}()
+			return conn
+		}
+		return nil
+	}
+}
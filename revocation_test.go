@@ -0,0 +1,227 @@
+package tunkit
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func krlString(b []byte) []byte {
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(b)))
+	return append(out, b...)
+}
+
+func krlSection(sectionType byte, body ...[]byte) []byte {
+	return append([]byte{sectionType}, krlString(bytes.Join(body, nil))...)
+}
+
+func krlUint64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+// krl builds a version 1 KRL with the given sections.
+func krl(sections ...[]byte) []byte {
+	data := append([]byte{}, krlMagic...)
+	data = binary.BigEndian.AppendUint32(data, 1)
+	// krl_version, generated_date, flags
+	data = append(data, make([]byte, 24)...)
+	// reserved, comment
+	data = append(data, krlString(nil)...)
+	data = append(data, krlString([]byte("test"))...)
+	for _, section := range sections {
+		data = append(data, section...)
+	}
+	return data
+}
+
+func TestParseKRL(t *testing.T) {
+	ca := newTestSigner(t)
+	revokedKey := newTestSigner(t).PublicKey()
+	otherKey := newTestSigner(t).PublicKey()
+
+	newCert := func(serial uint64, keyID string) *gossh.Certificate {
+		cert := &gossh.Certificate{
+			Key:         otherKey,
+			Serial:      serial,
+			CertType:    gossh.UserCert,
+			KeyId:       keyID,
+			ValidBefore: gossh.CertTimeInfinity,
+		}
+		err := cert.SignCert(rand.Reader, ca)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	sha256Sum := sha256.Sum256(revokedKey.Marshal())
+	certSection := func(sub ...[]byte) []byte {
+		body := append([][]byte{krlString(ca.PublicKey().Marshal()), krlString(nil)}, sub...)
+		return krlSection(krlSectionCertificates, body...)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+		revoked []gossh.PublicKey
+		allowed []gossh.PublicKey
+	}{
+		{
+			name:    "empty",
+			data:    krl(),
+			allowed: []gossh.PublicKey{revokedKey},
+		},
+		{
+			name:    "bad magic",
+			data:    append([]byte("SSHKRL\n\x01"), krl()[len(krlMagic):]...),
+			wantErr: true,
+		},
+		{
+			name: "unsupported version",
+			data: func() []byte {
+				data := krl()
+				binary.BigEndian.PutUint32(data[len(krlMagic):], 2)
+				return data
+			}(),
+			wantErr: true,
+		},
+		{
+			name:    "truncated header",
+			data:    krl()[:len(krlMagic)+10],
+			wantErr: true,
+		},
+		{
+			name:    "explicit key",
+			data:    krl(krlSection(krlSectionExplicitKey, krlString(revokedKey.Marshal()))),
+			revoked: []gossh.PublicKey{revokedKey},
+			allowed: []gossh.PublicKey{otherKey},
+		},
+		{
+			name:    "invalid explicit key",
+			data:    krl(krlSection(krlSectionExplicitKey, krlString([]byte("not a key")))),
+			wantErr: true,
+		},
+		{
+			name:    "sha256 fingerprint",
+			data:    krl(krlSection(krlSectionFingerprintSHA256, krlString(sha256Sum[:]))),
+			revoked: []gossh.PublicKey{revokedKey},
+			allowed: []gossh.PublicKey{otherKey},
+		},
+		{
+			name: "sha1 fingerprint",
+			data: func() []byte {
+				sum := sha1.Sum(revokedKey.Marshal())
+				return krl(krlSection(krlSectionFingerprintSHA1, krlString(sum[:])))
+			}(),
+			revoked: []gossh.PublicKey{revokedKey},
+			allowed: []gossh.PublicKey{otherKey},
+		},
+		{
+			name: "cert serial list",
+			data: krl(certSection(
+				krlSection(krlCertSerialList, krlUint64(7), krlUint64(9)),
+			)),
+			revoked: []gossh.PublicKey{newCert(7, "a"), newCert(9, "a")},
+			allowed: []gossh.PublicKey{newCert(8, "a"), otherKey},
+		},
+		{
+			name: "cert serial range",
+			data: krl(certSection(
+				krlSection(krlCertSerialRange, krlUint64(10), krlUint64(20)),
+			)),
+			revoked: []gossh.PublicKey{newCert(10, "a"), newCert(20, "a")},
+			allowed: []gossh.PublicKey{newCert(9, "a"), newCert(21, "a")},
+		},
+		{
+			name: "cert serial bitmap",
+			data: krl(certSection(
+				// bits 0 and 2 from offset 100
+				krlSection(krlCertSerialBitmap, krlUint64(100), krlString([]byte{0x05})),
+			)),
+			revoked: []gossh.PublicKey{newCert(100, "a"), newCert(102, "a")},
+			allowed: []gossh.PublicKey{newCert(101, "a"), newCert(103, "a")},
+		},
+		{
+			name: "cert key id",
+			data: krl(certSection(
+				krlSection(krlCertKeyID, krlString([]byte("stolen"))),
+			)),
+			revoked: []gossh.PublicKey{newCert(1, "stolen")},
+			allowed: []gossh.PublicKey{newCert(1, "laptop")},
+		},
+		{
+			name: "cert section of another ca",
+			data: krl(krlSection(
+				krlSectionCertificates,
+				krlString(otherKey.Marshal()),
+				krlString(nil),
+				krlSection(krlCertSerialList, krlUint64(7)),
+			)),
+			allowed: []gossh.PublicKey{newCert(7, "a")},
+		},
+		{
+			name: "truncated serial range",
+			data: krl(certSection(
+				krlSection(krlCertSerialRange, krlUint64(10)),
+			)),
+			wantErr: true,
+		},
+		{
+			name: "unknown cert section",
+			data: krl(certSection(
+				krlSection(0x30, krlUint64(1)),
+			)),
+			wantErr: true,
+		},
+		{
+			name:    "unknown section",
+			data:    krl(krlSection(9, krlUint64(1))),
+			wantErr: true,
+		},
+		{
+			name: "truncated section",
+			data: func() []byte {
+				data := krl(krlSection(krlSectionFingerprintSHA256, krlString(sha256Sum[:])))
+				return data[:len(data)-4]
+			}(),
+			wantErr: true,
+		},
+		{
+			name: "ignored after signature",
+			data: krl(
+				krlSection(krlSectionFingerprintSHA256, krlString(sha256Sum[:])),
+				krlSection(krlSectionSignature, krlString([]byte("sig"))),
+				[]byte("garbage"),
+			),
+			revoked: []gossh.PublicKey{revokedKey},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revs, err := parseKRL(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseKRL() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			for _, key := range tt.revoked {
+				if !revs.revoked(key) {
+					t.Errorf("%s not revoked", gossh.FingerprintSHA256(key))
+				}
+			}
+			for _, key := range tt.allowed {
+				if revs.revoked(key) {
+					t.Errorf("%s revoked", gossh.FingerprintSHA256(key))
+				}
+			}
+		})
+	}
+}
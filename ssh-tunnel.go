@@ -0,0 +1,222 @@
+package tunkit
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/charmbracelet/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	ErrNoAgent              = errors.New("no ssh agent forwarded, connect with `ssh -A`")
+	errNoUpstreamCredential = errors.New("no credential configured for upstream")
+
+	agentChannelType = "auth-agent@openssh.com"
+)
+
+// OpenAgent opens the agent the user forwarded with `ssh -A`. Close the
+// returned channel when done with the agent.
+func OpenAgent(ctx ssh.Context) (agent.ExtendedAgent, gossh.Channel, error) {
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(gossh.Conn)
+	if !ok || conn == nil {
+		return nil, nil, fmt.Errorf("conn not set on `ssh.Context()` for connection")
+	}
+	ch, reqs, err := conn.OpenChannel(agentChannelType, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrNoAgent, err)
+	}
+	go gossh.DiscardRequests(reqs)
+	return agent.NewClient(ch), ch, nil
+}
+
+// Upstream is an SSH server a tunnel forwards through and the address it
+// dials from there.
+type Upstream struct {
+	// Addr of the upstream SSH server (host:port).
+	Addr string
+	// User defaults to the downstream user.
+	User string
+	// Network and Dest are dialed from the upstream server, Network
+	// defaults to tcp.
+	Network string
+	Dest    string
+	// UseAgent authenticates with the downstream user's forwarded agent so
+	// upstream audit logs show the real user.
+	UseAgent bool
+	// Signer is used when UseAgent is false.
+	Signer          gossh.Signer
+	HostKeyCallback gossh.HostKeyCallback
+}
+
+// SSHTunnelHandler is a Tunnel that forwards every channel through an
+// upstream SSH server, one upstream connection per downstream connection.
+// Resolver, when set, picks the upstream per user instead of Upstream.
+type SSHTunnelHandler struct {
+	Upstream *Upstream
+	Resolver UpstreamResolver
+	Logger   *slog.Logger
+}
+
+func NewSSHTunnelHandler(upstream *Upstream, logger *slog.Logger) *SSHTunnelHandler {
+	return &SSHTunnelHandler{
+		Upstream: upstream,
+		Logger:   logger,
+	}
+}
+
+// upstreamConn is the upstream connection of one downstream connection.
+type upstreamConn struct {
+	sync.Mutex
+	upstream *Upstream
+	client   *gossh.Client
+}
+
+type ctxUpstreamKey struct{}
+
+func getUpstreamCtx(ctx ssh.Context) *upstreamConn {
+	ctx.Lock()
+	defer ctx.Unlock()
+	uc, ok := ctx.Value(ctxUpstreamKey{}).(*upstreamConn)
+	if uc == nil || !ok {
+		uc = &upstreamConn{}
+		ctx.SetValue(ctxUpstreamKey{}, uc)
+	}
+	return uc
+}
+
+func dialUpstream(ctx ssh.Context, upstream *Upstream, logger *slog.Logger) (*gossh.Client, error) {
+	if upstream.HostKeyCallback == nil {
+		return nil, fmt.Errorf("no host key callback configured for upstream %s", upstream.Addr)
+	}
+
+	user := upstream.User
+	if user == "" {
+		user = ctx.User()
+	}
+
+	var auth gossh.AuthMethod
+	if upstream.UseAgent {
+		agentClient, ch, err := OpenAgent(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// the agent is only needed for the handshake
+		defer ch.Close()
+		auth = gossh.PublicKeysCallback(agentClient.Signers)
+	} else if upstream.Signer != nil {
+		auth = gossh.PublicKeys(upstream.Signer)
+	} else {
+		return nil, errNoUpstreamCredential
+	}
+
+	rawConn, err := net.Dial("tcp", upstream.Addr)
+	if err != nil {
+		return nil, err
+	}
+	sshConn, chans, reqs, err := gossh.NewClientConn(rawConn, upstream.Addr, &gossh.ClientConfig{
+		Auth:            []gossh.AuthMethod{auth},
+		HostKeyCallback: upstream.HostKeyCallback,
+		User:            user,
+	})
+	if err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("upstream %s@%s: %w", user, upstream.Addr, err)
+	}
+
+	logger.Info(
+		"connected to upstream",
+		"upstream", upstream.Addr,
+		"upstreamUser", user,
+		"agent", upstream.UseAgent,
+		"user", ctx.User(),
+		"fingerprint", GetFingerprint(ctx),
+		"sessionID", ctx.SessionID(),
+	)
+	return gossh.NewClient(sshConn, chans, reqs), nil
+}
+
+// upstreamClient returns the upstream connection of ctx, dialing it when
+// there is none yet or when it is dead.
+func (h *SSHTunnelHandler) upstreamClient(ctx ssh.Context, dead *gossh.Client) (*gossh.Client, *Upstream, error) {
+	uc := getUpstreamCtx(ctx)
+	uc.Lock()
+	defer uc.Unlock()
+	if dead != nil && uc.client == dead {
+		_ = dead.Close()
+		uc.client = nil
+	}
+	if uc.client == nil {
+		upstream := h.Upstream
+		if h.Resolver != nil {
+			var err error
+			upstream, err = h.Resolver.ResolveUpstream(ctx)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		client, err := dialUpstream(ctx, upstream, h.Logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		uc.upstream = upstream
+		uc.client = client
+	}
+	return uc.client, uc.upstream, nil
+}
+
+func (h *SSHTunnelHandler) CreateConn(ctx ssh.Context) (net.Conn, error) {
+	client, upstream, err := h.upstreamClient(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.Dial(upstreamNetwork(upstream), upstream.Dest)
+	var openErr *gossh.OpenChannelError
+	if err == nil || errors.As(err, &openErr) {
+		return conn, err
+	}
+
+	// anything but a rejected channel means the connection is gone, e.g.
+	// the upstream server restarted
+	h.Logger.Info(
+		"redialing upstream",
+		"addr", upstream.Addr,
+		"user", ctx.User(),
+		"sessionID", ctx.SessionID(),
+		"err", err,
+	)
+	client, upstream, err = h.upstreamClient(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	return client.Dial(upstreamNetwork(upstream), upstream.Dest)
+}
+
+func upstreamNetwork(upstream *Upstream) string {
+	if upstream.Network == "" {
+		return "tcp"
+	}
+	return upstream.Network
+}
+
+func (h *SSHTunnelHandler) GetLogger() *slog.Logger {
+	return h.Logger
+}
+
+func (h *SSHTunnelHandler) Close(ctx ssh.Context) error {
+	uc := getUpstreamCtx(ctx)
+	uc.Lock()
+	defer uc.Unlock()
+	if uc.client == nil {
+		return nil
+	}
+	err := uc.client.Close()
+	uc.client = nil
+	uc.upstream = nil
+	return err
+}
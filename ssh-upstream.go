@@ -0,0 +1,170 @@
+package tunkit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/charmbracelet/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"gopkg.in/yaml.v3"
+)
+
+// upstreamUserRe is a portable POSIX user name.
+var upstreamUserRe = regexp.MustCompile(`^[a-z_][a-z0-9_.-]{0,31}$`)
+
+// UpstreamResolver picks the upstream of a downstream identity.
+type UpstreamResolver interface {
+	ResolveUpstream(ctx ssh.Context) (*Upstream, error)
+}
+
+type UpstreamResolverFunc func(ctx ssh.Context) (*Upstream, error)
+
+func (fn UpstreamResolverFunc) ResolveUpstream(ctx ssh.Context) (*Upstream, error) {
+	return fn(ctx)
+}
+
+// UpstreamMapping sends identities matching one of Keys (SHA256
+// fingerprints or authorized_keys lines) or certificate Principals (which
+// require WithUserCAs) to an upstream. User names are chosen by the client so
+// they never select a mapping. "{user}" in User is replaced with the
+// downstream user and requires Agent so the upstream checks the user's own
+// key.
+type UpstreamMapping struct {
+	Keys       []string `yaml:"keys"`
+	Principals []string `yaml:"principals"`
+
+	Addr    string `yaml:"addr"`
+	User    string `yaml:"user"`
+	Network string `yaml:"network"`
+	Dest    string `yaml:"dest"`
+	// Agent uses the user's forwarded agent, otherwise Key is the path of
+	// the private key used upstream.
+	Agent bool   `yaml:"agent"`
+	Key   string `yaml:"key"`
+	// KnownHosts is the known_hosts file verifying the upstream host key.
+	KnownHosts            string `yaml:"known_hosts"`
+	InsecureIgnoreHostKey bool   `yaml:"insecure_ignore_host_key"`
+
+	signer          gossh.Signer
+	hostKeyCallback gossh.HostKeyCallback
+}
+
+// UpstreamConfig is the YAML document loaded by LoadUpstreamConfig, the
+// first matching mapping wins:
+//
+//	upstreams:
+//	  - principals: [data-team]
+//	    addr: db-bastion:22
+//	    user: "{user}"
+//	    dest: localhost:5432
+//	    agent: true
+//	    known_hosts: /etc/tunkit/known_hosts
+//	  - keys: ["SHA256:..."]
+//	    addr: build:22
+//	    user: deploy
+//	    dest: localhost:8080
+//	    key: /etc/tunkit/deploy_ed25519
+//	    known_hosts: /etc/tunkit/known_hosts
+type UpstreamConfig struct {
+	Upstreams []*UpstreamMapping `yaml:"upstreams"`
+}
+
+func ParseUpstreamConfig(data []byte) (*UpstreamConfig, error) {
+	config := &UpstreamConfig{}
+	// unknown fields are errors so a removed `users:` cannot silently widen
+	// a mapping
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err := dec.Decode(config)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	for i, mapping := range config.Upstreams {
+		if mapping.Addr == "" || mapping.Dest == "" {
+			return nil, fmt.Errorf("upstream %d requires addr and dest", i)
+		}
+		if len(mapping.Keys) == 0 && len(mapping.Principals) == 0 {
+			return nil, fmt.Errorf("upstream %d requires keys or principals", i)
+		}
+		if strings.Contains(mapping.User, "{user}") && !mapping.Agent {
+			return nil, fmt.Errorf("upstream %d can only use {user} with agent", i)
+		}
+
+		err := normalizeKeys(mapping.Keys)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %d has invalid key: %w", i, err)
+		}
+
+		if !mapping.Agent {
+			if mapping.Key == "" {
+				return nil, fmt.Errorf("upstream %d requires agent or key", i)
+			}
+			data, err := os.ReadFile(mapping.Key)
+			if err != nil {
+				return nil, fmt.Errorf("upstream %d: %w", i, err)
+			}
+			mapping.signer, err = gossh.ParsePrivateKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("upstream %d: %w", i, err)
+			}
+		}
+
+		switch {
+		case mapping.KnownHosts != "":
+			mapping.hostKeyCallback, err = knownhosts.New(mapping.KnownHosts)
+			if err != nil {
+				return nil, fmt.Errorf("upstream %d: %w", i, err)
+			}
+		case mapping.InsecureIgnoreHostKey:
+			mapping.hostKeyCallback = gossh.InsecureIgnoreHostKey()
+		default:
+			return nil, fmt.Errorf("upstream %d requires known_hosts or insecure_ignore_host_key", i)
+		}
+	}
+
+	return config, nil
+}
+
+func LoadUpstreamConfig(path string) (*UpstreamConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := ParseUpstreamConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+func (c *UpstreamConfig) ResolveUpstream(ctx ssh.Context) (*Upstream, error) {
+	for _, mapping := range c.Upstreams {
+		if !matchIdentity(ctx, mapping.Keys, mapping.Principals) {
+			continue
+		}
+		user := mapping.User
+		if strings.Contains(user, "{user}") {
+			if !upstreamUserRe.MatchString(ctx.User()) {
+				return nil, fmt.Errorf("invalid user name %q for upstream %s", ctx.User(), mapping.Addr)
+			}
+			user = strings.ReplaceAll(user, "{user}", ctx.User())
+		}
+		return &Upstream{
+			Addr:            mapping.Addr,
+			User:            user,
+			Network:         mapping.Network,
+			Dest:            mapping.Dest,
+			UseAgent:        mapping.Agent,
+			Signer:          mapping.signer,
+			HostKeyCallback: mapping.hostKeyCallback,
+		}, nil
+	}
+	return nil, fmt.Errorf("no upstream configured for %s (%s)", ctx.User(), GetFingerprint(ctx))
+}
@@ -0,0 +1,109 @@
+package tunkit
+
+import (
+	"testing"
+)
+
+func TestParseUpstreamConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{
+			name: "key with agent",
+			config: `
+upstreams:
+  - keys: ["SHA256:abc"]
+    addr: bastion:22
+    user: "{user}"
+    dest: localhost:5432
+    agent: true
+    insecure_ignore_host_key: true
+`,
+		},
+		{
+			name: "users are not an identity",
+			config: `
+upstreams:
+  - users: [ci]
+    keys: ["SHA256:abc"]
+    addr: bastion:22
+    dest: localhost:5432
+    agent: true
+    insecure_ignore_host_key: true
+`,
+			wantErr: true,
+		},
+		{
+			name: "no keys or principals",
+			config: `
+upstreams:
+  - addr: bastion:22
+    dest: localhost:5432
+    agent: true
+    insecure_ignore_host_key: true
+`,
+			wantErr: true,
+		},
+		{
+			name: "user placeholder with shared key",
+			config: `
+upstreams:
+  - principals: [ops]
+    addr: bastion:22
+    user: "{user}"
+    dest: localhost:5432
+    key: /nonexistent
+    insecure_ignore_host_key: true
+`,
+			wantErr: true,
+		},
+		{
+			name: "no host key verification",
+			config: `
+upstreams:
+  - principals: [ops]
+    addr: bastion:22
+    dest: localhost:5432
+    agent: true
+`,
+			wantErr: true,
+		},
+		{
+			name:   "empty",
+			config: ``,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseUpstreamConfig([]byte(tt.config))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseUpstreamConfig() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUpstreamUserRe(t *testing.T) {
+	tests := []struct {
+		user string
+		want bool
+	}{
+		{"alice", true},
+		{"deploy-bot", true},
+		{"_svc.1", true},
+		{"root@evil", false},
+		{"-oProxyCommand", false},
+		{"a b", false},
+		{"", false},
+		{"Alice", false},
+	}
+
+	for _, tt := range tests {
+		if got := upstreamUserRe.MatchString(tt.user); got != tt.want {
+			t.Errorf("upstreamUserRe.MatchString(%q) = %v, want %v", tt.user, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package tunkit
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ProcessCredential is the uid and gid a process runs as.
+type ProcessCredential struct {
+	Uid    uint32
+	Gid    uint32
+	Groups []uint32
+}
+
+// ProcessLimits are resource limits applied to a process, zero leaves a
+// limit unchanged. They are only supported on linux.
+type ProcessLimits struct {
+	// NoFile is the number of open files.
+	NoFile uint64
+	// NProc is the number of processes of the process's uid.
+	NProc uint64
+	// AddressSpace is the size of the virtual memory in bytes.
+	AddressSpace uint64
+	// CPU is the CPU time in seconds.
+	CPU uint64
+}
+
+// AccountCredential runs processes as the local account mapped to the
+// SHA256 fingerprint of the user's key, see GetFingerprint. Users without an
+// entry are refused.
+func AccountCredential(accounts map[string]string) func(ctx ssh.Context) (*ProcessCredential, error) {
+	return func(ctx ssh.Context) (*ProcessCredential, error) {
+		for _, fingerprint := range getKeyFingerprints(ctx) {
+			if name, ok := accounts[fingerprint]; ok {
+				u, err := user.Lookup(name)
+				if err != nil {
+					return nil, err
+				}
+				return userCredential(u)
+			}
+		}
+		return nil, fmt.Errorf("no account mapped to key %s", GetFingerprint(ctx))
+	}
+}
+
+// LocalUserCredential runs processes as the local account named like the
+// SSH user. The name is picked by the client, so the account's
+// ~/.ssh/authorized_keys has to list the key the user authenticated with,
+// for certificates the certified key. Keys restricted there, for example
+// with command=, from= or restrict, are refused since tunkit cannot honor
+// the restrictions.
+func LocalUserCredential(ctx ssh.Context) (*ProcessCredential, error) {
+	pubkey, err := getPubkeyCtx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cert, ok := pubkey.(*gossh.Certificate); ok {
+		pubkey = cert.Key
+	}
+
+	u, err := user.Lookup(ctx.User())
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(u.HomeDir, ".ssh", "authorized_keys"))
+	if err != nil {
+		return nil, err
+	}
+	err = checkAuthorizedKeys(data, pubkey)
+	if err != nil {
+		return nil, fmt.Errorf("account %s: %w", u.Username, err)
+	}
+	return userCredential(u)
+}
+
+// authorizedKeyOptions are the authorized_keys options that do not restrict
+// what the key may run.
+var authorizedKeyOptions = []string{
+	"no-agent-forwarding",
+	"no-pty",
+	"no-user-rc",
+	"no-x11-forwarding",
+}
+
+// checkAuthorizedKeys returns nil when the first line of data for pubkey
+// has no restrictive options, like sshd it ignores the lines after it.
+func checkAuthorizedKeys(data []byte, pubkey gossh.PublicKey) error {
+	for len(data) > 0 {
+		key, _, options, rest, err := gossh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		data = rest
+		if slices.Contains(options, "cert-authority") || !ssh.KeysEqual(key, pubkey) {
+			continue
+		}
+		for _, option := range options {
+			name, _, _ := strings.Cut(option, "=")
+			if !slices.Contains(authorizedKeyOptions, strings.ToLower(name)) {
+				return fmt.Errorf("key is restricted with %s", name)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("key is not authorized")
+}
+
+// userCredential returns the uid and gids of an account, root is refused.
+func userCredential(u *user.User) (*ProcessCredential, error) {
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	if uid == 0 {
+		return nil, fmt.Errorf("refusing to run processes as root")
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	cred := &ProcessCredential{Uid: uint32(uid), Gid: uint32(gid)}
+	groups, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		gid, err := strconv.ParseUint(group, 10, 32)
+		if err != nil {
+			continue
+		}
+		cred.Groups = append(cred.Groups, uint32(gid))
+	}
+	return cred, nil
+}
+
+// ExecTunnelHandler is an inetd-style Tunnel: every channel starts Command
+// and the process's stdin and stdout are the connection. The user's
+// identity is passed in the TUNKIT_* environment variables and the process
+// is killed when the channel closes.
+type ExecTunnelHandler struct {
+	Command []string
+	Dir     string
+	// Env defaults to the environment of the server, or only PATH, HOME and
+	// USER of the account when Credential is set so the server's secrets
+	// stay out of other accounts' processes.
+	Env []string
+	// Credential, when set, picks the uid and gid of the process per user,
+	// see AccountCredential and LocalUserCredential.
+	Credential func(ctx ssh.Context) (*ProcessCredential, error)
+	Limits     *ProcessLimits
+	Logger     *slog.Logger
+}
+
+func NewExecTunnelHandler(command []string, logger *slog.Logger) *ExecTunnelHandler {
+	return &ExecTunnelHandler{
+		Command: command,
+		Logger:  logger,
+	}
+}
+
+type ctxExecSetKey struct{}
+
+func getExecSetCtx(ctx ssh.Context) *connSet {
+	ctx.Lock()
+	defer ctx.Unlock()
+	set, ok := ctx.Value(ctxExecSetKey{}).(*connSet)
+	if set == nil || !ok {
+		set = &connSet{conns: map[net.Conn]struct{}{}}
+		ctx.SetValue(ctxExecSetKey{}, set)
+	}
+	return set
+}
+
+func (h *ExecTunnelHandler) GetLogger() *slog.Logger {
+	return h.Logger
+}
+
+func (h *ExecTunnelHandler) Close(ctx ssh.Context) error {
+	set := getExecSetCtx(ctx)
+	set.Lock()
+	conns := set.conns
+	set.conns = map[net.Conn]struct{}{}
+	set.Unlock()
+	for conn := range conns {
+		_ = conn.Close()
+	}
+	return nil
+}
+
+func (h *ExecTunnelHandler) CreateConn(ctx ssh.Context) (net.Conn, error) {
+	if len(h.Command) == 0 {
+		return nil, fmt.Errorf("no command configured")
+	}
+
+	var cred *ProcessCredential
+	if h.Credential != nil {
+		var err error
+		cred, err = h.Credential(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cmd := exec.Command(h.Command[0], h.Command[1:]...)
+	cmd.Dir = h.Dir
+	cmd.Env = processEnv(h.Env, cred)
+	// appended last so they cannot be overridden
+	cmd.Env = append(cmd.Env, identityEnv(ctx)...)
+	cmd.Env = append(
+		cmd.Env,
+		EnvSessionID+"="+ctx.SessionID(),
+		EnvRemoteAddr+"="+ctx.RemoteAddr().String(),
+	)
+	log := h.GetLogger().With(
+		"cmd", h.Command[0],
+		"user", ctx.User(),
+		"sessionID", ctx.SessionID(),
+	)
+	stderr := &logWriter{log: log}
+	cmd.Stderr = stderr
+	// do not wait on stderr forever when the process left children behind
+	cmd.WaitDelay = time.Second
+
+	err := setProcessAttrs(cmd, cred)
+	if err != nil {
+		return nil, err
+	}
+
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, err
+	}
+	cmd.Stdin = stdinR
+	cmd.Stdout = stdoutW
+
+	err = startProcess(cmd, h.Limits)
+	// the child has its own copies now
+	stdinR.Close()
+	stdoutW.Close()
+	if err != nil {
+		stdinW.Close()
+		stdoutR.Close()
+		return nil, err
+	}
+
+	log = log.With("pid", cmd.Process.Pid)
+
+	conn := &execConn{
+		ctx:    ctx,
+		cmd:    cmd,
+		stdin:  stdinW,
+		stdout: stdoutR,
+		done:   make(chan struct{}),
+	}
+
+	set := getExecSetCtx(ctx)
+	set.Lock()
+	set.conns[conn] = struct{}{}
+	set.Unlock()
+
+	log.Info("process started")
+	go func() {
+		err := cmd.Wait()
+		stderr.Flush()
+		close(conn.done)
+		set.Lock()
+		delete(set.conns, conn)
+		set.Unlock()
+		log.Info("process exited", "err", err)
+	}()
+
+	return conn, nil
+}
+
+// processEnv returns env, or the default environment of a process running
+// with cred when it is nil.
+func processEnv(env []string, cred *ProcessCredential) []string {
+	if env != nil {
+		return slices.Clone(env)
+	}
+	if cred == nil {
+		return os.Environ()
+	}
+	env = []string{"PATH=/usr/local/bin:/usr/bin:/bin"}
+	u, err := user.LookupId(strconv.FormatUint(uint64(cred.Uid), 10))
+	if err == nil {
+		env = append(env, "HOME="+u.HomeDir, "USER="+u.Username)
+	}
+	return env
+}
+
+// logWriter logs every line written to it, it prefixes the stderr of
+// processes with who they were started for.
+type logWriter struct {
+	log *slog.Logger
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, b...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.log.Info("process stderr", "line", string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	if len(w.buf) > 4096 {
+		w.log.Info("process stderr", "line", string(w.buf))
+		w.buf = nil
+	}
+	return len(b), nil
+}
+
+// Flush logs a last line without a trailing newline.
+func (w *logWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.log.Info("process stderr", "line", string(w.buf))
+		w.buf = nil
+	}
+}
+
+// execConn reads from the stdout and writes to the stdin of a process.
+type execConn struct {
+	ctx    ssh.Context
+	cmd    *exec.Cmd
+	stdin  *os.File
+	stdout *os.File
+	once   sync.Once
+	done   chan struct{}
+}
+
+func (c *execConn) Read(b []byte) (int, error) {
+	return c.stdout.Read(b)
+}
+
+func (c *execConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+// CloseWrite closes stdin so the process sees EOF and can still respond.
+func (c *execConn) CloseWrite() error {
+	return c.stdin.Close()
+}
+
+func (c *execConn) Close() error {
+	c.once.Do(func() {
+		_ = c.stdin.Close()
+		select {
+		case <-c.done:
+		default:
+			killProcess(c.cmd)
+		}
+		<-c.done
+		_ = c.stdout.Close()
+	})
+	return nil
+}
+
+func (c *execConn) LocalAddr() net.Addr {
+	return c.ctx.LocalAddr()
+}
+
+func (c *execConn) RemoteAddr() net.Addr {
+	return c.ctx.RemoteAddr()
+}
+
+func (c *execConn) SetDeadline(t time.Time) error {
+	err := c.stdout.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.stdin.SetWriteDeadline(t)
+}
+
+func (c *execConn) SetReadDeadline(t time.Time) error {
+	return c.stdout.SetReadDeadline(t)
+}
+
+func (c *execConn) SetWriteDeadline(t time.Time) error {
+	return c.stdin.SetWriteDeadline(t)
+}
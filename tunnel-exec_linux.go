@@ -0,0 +1,88 @@
+//go:build linux
+
+package tunkit
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func setProcessAttrs(cmd *exec.Cmd, cred *ProcessCredential) error {
+	// own process group so children are killed with the process
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+	if cred != nil {
+		cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid:    cred.Uid,
+			Gid:    cred.Gid,
+			Groups: cred.Groups,
+		}
+	}
+	return nil
+}
+
+// startProcess starts cmd with its limits in place before it runs any code:
+// the child stops at exec under ptrace, gets its limits and is released.
+func startProcess(cmd *exec.Cmd, limits *ProcessLimits) error {
+	if limits == nil {
+		return cmd.Start()
+	}
+	// ptrace requests have to come from the thread that started the child
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	cmd.SysProcAttr.Ptrace = true
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	pid := cmd.Process.Pid
+	var status unix.WaitStatus
+	_, err = unix.Wait4(pid, &status, unix.WALL, nil)
+	if err == nil && !status.Stopped() {
+		err = fmt.Errorf("process did not stop at exec")
+	}
+	if err == nil {
+		err = setProcessLimits(pid, limits)
+	}
+	if err == nil {
+		err = unix.PtraceDetach(pid)
+	}
+	if err != nil {
+		killProcess(cmd)
+		_ = cmd.Wait()
+		return fmt.Errorf("could not set process limits: %w", err)
+	}
+	return nil
+}
+
+func setProcessLimits(pid int, limits *ProcessLimits) error {
+	for resource, value := range map[int]uint64{
+		unix.RLIMIT_NOFILE: limits.NoFile,
+		unix.RLIMIT_NPROC:  limits.NProc,
+		unix.RLIMIT_AS:     limits.AddressSpace,
+		unix.RLIMIT_CPU:    limits.CPU,
+	} {
+		if value == 0 {
+			continue
+		}
+		err := unix.Prlimit(pid, resource, &unix.Rlimit{Cur: value, Max: value}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func terminateProcess(cmd *exec.Cmd) {
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+func killProcess(cmd *exec.Cmd) {
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
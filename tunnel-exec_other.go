@@ -0,0 +1,35 @@
+//go:build !linux
+
+package tunkit
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+func setProcessAttrs(cmd *exec.Cmd, cred *ProcessCredential) error {
+	if cred != nil {
+		return fmt.Errorf("process credentials are only supported on linux")
+	}
+	return nil
+}
+
+func startProcess(cmd *exec.Cmd, limits *ProcessLimits) error {
+	if limits != nil {
+		return fmt.Errorf("process limits are only supported on linux")
+	}
+	return cmd.Start()
+}
+
+func terminateProcess(cmd *exec.Cmd) {
+	// not every platform can send signals other than kill
+	err := cmd.Process.Signal(syscall.SIGTERM)
+	if err != nil {
+		_ = cmd.Process.Kill()
+	}
+}
+
+func killProcess(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
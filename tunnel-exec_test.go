@@ -0,0 +1,76 @@
+package tunkit
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestCheckAuthorizedKeys(t *testing.T) {
+	key := newTestSigner(t).PublicKey()
+	other := newTestSigner(t).PublicKey()
+	line := func(options string, key gossh.PublicKey) string {
+		authorized := strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key)))
+		if options == "" {
+			return authorized + "\n"
+		}
+		return options + " " + authorized + "\n"
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"listed", line("", other) + line("", key), false},
+		{"not listed", line("", other), true},
+		{"empty", "", true},
+		{"harmless options", line("no-pty,no-X11-forwarding", key), false},
+		{"forced command", line(`command="/usr/bin/backup"`, key), true},
+		{"source restriction", line(`from="10.0.0.0/8"`, key), true},
+		{"restrict", line("restrict", key), true},
+		{"restrict with pty", line("restrict,pty", key), true},
+		{"port forwarding", line("no-port-forwarding", key), true},
+		{"first line wins", line("restrict", key) + line("", key), true},
+		{"cert authority", line("cert-authority", key), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkAuthorizedKeys([]byte(tt.data), key)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkAuthorizedKeys() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProcessEnv(t *testing.T) {
+	t.Setenv("TUNKIT_TEST_SECRET", "hunter2")
+
+	tests := []struct {
+		name       string
+		env        []string
+		cred       *ProcessCredential
+		wantSecret bool
+	}{
+		{"server environment", nil, nil, true},
+		{"other account", nil, &ProcessCredential{Uid: 65534, Gid: 65534}, false},
+		{"explicit", []string{"TUNKIT_TEST_SECRET=hunter2"}, &ProcessCredential{Uid: 65534, Gid: 65534}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := processEnv(tt.env, tt.cred)
+			if got := slices.Contains(env, "TUNKIT_TEST_SECRET=hunter2"); got != tt.wantSecret {
+				t.Errorf("processEnv() has the secret = %v, want %v: %q", got, tt.wantSecret, env)
+			}
+			hasPath := slices.ContainsFunc(env, func(v string) bool { return strings.HasPrefix(v, "PATH=") })
+			if tt.env == nil && !hasPath {
+				t.Errorf("processEnv() has no PATH: %q", env)
+			}
+		})
+	}
+}
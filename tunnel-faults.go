@@ -0,0 +1,191 @@
+package tunkit
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+)
+
+var ErrInjectedDialFailure = errors.New("dial failed (injected fault)")
+
+// Faults degrade the conns of a tunnel to test how clients cope with flaky
+// networks. Zero values disable a fault.
+type Faults struct {
+	// Latency is added to every read and write, plus a random amount up to
+	// Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+	// Bandwidth caps each direction in bytes per second.
+	Bandwidth int64
+	// ResetRate is the probability that a conn is reset at a random point
+	// within ResetWithin (defaults to 10s) after it is created. Only a
+	// *net.TCPConn sends a RST, other conns (pools, exec tunnels or other
+	// decorators) are closed instead.
+	ResetRate   float64
+	ResetWithin time.Duration
+	// DialFailureRate is the probability that CreateConn fails.
+	DialFailureRate float64
+}
+
+// FaultInjector applies Faults to the conns it decorates. Faults can be set
+// per identity (user or key fingerprint) and changed at runtime.
+type FaultInjector struct {
+	mu         sync.RWMutex
+	defaults   *Faults
+	identities map[string]*Faults
+}
+
+func NewFaultInjector(defaults *Faults) *FaultInjector {
+	return &FaultInjector{
+		defaults:   defaults,
+		identities: map[string]*Faults{},
+	}
+}
+
+// SetDefault changes the faults of identities without their own, nil
+// disables them.
+func (fi *FaultInjector) SetDefault(faults *Faults) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.defaults = faults
+}
+
+// Set the faults for a user or SHA256 key fingerprint, nil removes them.
+func (fi *FaultInjector) Set(identity string, faults *Faults) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if faults == nil {
+		delete(fi.identities, identity)
+		return
+	}
+	fi.identities[identity] = faults
+}
+
+func (fi *FaultInjector) faults(ctx ssh.Context) *Faults {
+	fi.mu.RLock()
+	defer fi.mu.RUnlock()
+	if faults, ok := fi.identities[GetFingerprint(ctx)]; ok {
+		return faults
+	}
+	if faults, ok := fi.identities[ctx.User()]; ok {
+		return faults
+	}
+	return fi.defaults
+}
+
+func (fi *FaultInjector) Decorator() TunnelDecorator {
+	return func(next CreateConnFn) CreateConnFn {
+		return func(ctx ssh.Context) (net.Conn, error) {
+			faults := fi.faults(ctx)
+			if faults != nil && faults.DialFailureRate > 0 && rand.Float64() < faults.DialFailureRate {
+				return nil, ErrInjectedDialFailure
+			}
+			conn, err := next(ctx)
+			if err != nil {
+				return nil, err
+			}
+			// wrapped even without faults so a later Set applies to it
+			return newFaultConn(conn, func() *Faults { return fi.faults(ctx) }, faults), nil
+		}
+	}
+}
+
+type faultConn struct {
+	net.Conn
+	// faults returns the current faults of the conn's identity, looked up
+	// on every read and write
+	faults func() *Faults
+	timer  *time.Timer
+}
+
+// newFaultConn decides on a reset with the faults at creation, latency and
+// bandwidth follow runtime changes.
+func newFaultConn(conn net.Conn, current func() *Faults, faults *Faults) *faultConn {
+	fc := &faultConn{Conn: conn, faults: current}
+	if faults != nil && faults.ResetRate > 0 && rand.Float64() < faults.ResetRate {
+		within := faults.ResetWithin
+		if within == 0 {
+			within = 10 * time.Second
+		}
+		after := time.Duration(rand.Int63n(int64(within)))
+		fc.timer = time.AfterFunc(after, fc.reset)
+	}
+	return fc
+}
+
+func (fc *faultConn) reset() {
+	if tcpConn, ok := fc.Conn.(*net.TCPConn); ok {
+		// send a RST instead of a FIN
+		_ = tcpConn.SetLinger(0)
+	}
+	_ = fc.Conn.Close()
+}
+
+func (faults *Faults) delay(n int) {
+	if faults == nil {
+		return
+	}
+	d := faults.Latency
+	if faults.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(faults.Jitter)))
+	}
+	if faults.Bandwidth > 0 {
+		d += time.Duration(int64(n) * int64(time.Second) / faults.Bandwidth)
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// chunk limits reads and writes to a tenth of a second of bandwidth so the
+// cap is smooth.
+func (faults *Faults) chunk(n int) int {
+	if faults == nil || faults.Bandwidth <= 0 {
+		return n
+	}
+	size := int(max(faults.Bandwidth/10, 1))
+	return min(n, size)
+}
+
+func (fc *faultConn) Read(b []byte) (int, error) {
+	n, err := fc.Conn.Read(b[:fc.faults().chunk(len(b))])
+	if n > 0 {
+		// looked up again, the read may have blocked across a change
+		fc.faults().delay(n)
+	}
+	return n, err
+}
+
+func (fc *faultConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		faults := fc.faults()
+		size := faults.chunk(len(b) - written)
+		faults.delay(size)
+		n, err := fc.Conn.Write(b[written : written+size])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (fc *faultConn) CloseWrite() error {
+	cw, ok := fc.Conn.(closeWriter)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return cw.CloseWrite()
+}
+
+func (fc *faultConn) Close() error {
+	if fc.timer != nil {
+		fc.timer.Stop()
+	}
+	return fc.Conn.Close()
+}
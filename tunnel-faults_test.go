@@ -0,0 +1,129 @@
+package tunkit
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestFaultInjectorIdentity(t *testing.T) {
+	key := newTestSigner(t).PublicKey()
+	fingerprint := gossh.FingerprintSHA256(key)
+
+	defaults := &Faults{Latency: time.Second}
+	byUser := &Faults{Bandwidth: 1024}
+	byKey := &Faults{ResetRate: 1}
+
+	tests := []struct {
+		name       string
+		user       string
+		identities map[string]*Faults
+		want       *Faults
+	}{
+		{"defaults", "alice", nil, defaults},
+		{"user", "alice", map[string]*Faults{"alice": byUser}, byUser},
+		{"other user", "bob", map[string]*Faults{"alice": byUser}, defaults},
+		{"key", "alice", map[string]*Faults{fingerprint: byKey}, byKey},
+		{"key before user", "alice", map[string]*Faults{"alice": byUser, fingerprint: byKey}, byKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fi := NewFaultInjector(defaults)
+			for identity, faults := range tt.identities {
+				fi.Set(identity, faults)
+			}
+			ctx := newTestContext(t, tt.user)
+			ctx.SetValue(ssh.ContextKeyPublicKey, key)
+			if got := fi.faults(ctx); got != tt.want {
+				t.Errorf("faults() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFaultInjectorRuntime(t *testing.T) {
+	fi := NewFaultInjector(nil)
+	tunnel := &testTunnel{}
+	wrapped := WrapTunnel(tunnel, fi.Decorator())
+	ctx := newTestContext(t, "alice")
+
+	conn, err := wrapped.CreateConn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		_, _ = io.Copy(io.Discard, tunnel.peers[0])
+	}()
+
+	write := func() time.Duration {
+		start := time.Now()
+		_, err := conn.Write([]byte("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+
+	latency := 100 * time.Millisecond
+	if d := write(); d >= latency {
+		t.Errorf("write without faults took %s", d)
+	}
+	// applies to the existing conn
+	fi.Set("alice", &Faults{Latency: latency})
+	if d := write(); d < latency {
+		t.Errorf("write after Set took %s, want at least %s", d, latency)
+	}
+	fi.Set("alice", nil)
+	if d := write(); d >= latency {
+		t.Errorf("write after removing the faults took %s", d)
+	}
+
+	fi.SetDefault(&Faults{DialFailureRate: 1})
+	_, err = wrapped.CreateConn(ctx)
+	if !errors.Is(err, ErrInjectedDialFailure) {
+		t.Errorf("CreateConn() err = %v, want %v", err, ErrInjectedDialFailure)
+	}
+}
+
+func TestFaultConnCloseWrite(t *testing.T) {
+	fi := NewFaultInjector(&Faults{Latency: time.Millisecond})
+	tunnel := &testTunnel{}
+	conn, err := WrapTunnel(tunnel, fi.Decorator()).CreateConn(newTestContext(t, "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer := tunnel.peers[0]
+	_ = peer.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go func() {
+		_, _ = conn.Write([]byte("PING"))
+		_ = conn.(closeWriter).CloseWrite()
+	}()
+	data, err := io.ReadAll(peer)
+	if err != nil {
+		t.Fatalf("reading until the half-close: %v", err)
+	}
+	if string(data) != "PING" {
+		t.Errorf("peer read %q, want %q", data, "PING")
+	}
+
+	// the conn still reads after its half-close
+	go func() {
+		_, _ = peer.Write([]byte("PONG"))
+		_ = peer.Close()
+	}()
+	data, err = io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "PONG" {
+		t.Errorf("conn read %q, want %q", data, "PONG")
+	}
+}
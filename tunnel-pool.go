@@ -0,0 +1,407 @@
+package tunkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+)
+
+type BalanceStrategy string
+
+var (
+	RoundRobin BalanceStrategy = "round-robin"
+	LeastConns BalanceStrategy = "least-conns"
+	// ConsistentByKey keeps a public key on the same backend. The username
+	// is chosen by the client so it is not used.
+	ConsistentByKey BalanceStrategy = "consistent-key"
+
+	ErrNoBackends = errors.New("no healthy backends")
+)
+
+// ringReplicas is the number of points per backend on the hash ring.
+const ringReplicas = 64
+
+type backend struct {
+	addr    string
+	conns   int
+	healthy bool
+	// health check results in a row
+	passes   int
+	failures int
+
+	// circuit breaker
+	dialFailures int
+	openUntil    time.Time
+	trial        bool
+}
+
+// BackendStats is a snapshot of a backend for operators.
+type BackendStats struct {
+	Addr        string
+	Conns       int
+	Healthy     bool
+	BreakerOpen bool
+}
+
+// BackendPool is a Tunnel that spreads conns across backend addresses. Run
+// Watch for active health checks; backends start healthy.
+type BackendPool struct {
+	// Network defaults to tcp.
+	Network  string
+	Strategy BalanceStrategy
+	// DialTimeout defaults to 5s.
+	DialTimeout time.Duration
+	// Retries is the number of other backends tried when a dial fails.
+	Retries int
+
+	// HealthPath, when set, checks backends with an HTTP GET that must
+	// return a status below 400 instead of a TCP connect.
+	HealthPath string
+	// HealthTimeout defaults to 2s. A backend goes down after Fall failed
+	// checks in a row (default 3) and back up after Rise passes (default 2).
+	HealthTimeout time.Duration
+	Rise          int
+	Fall          int
+
+	// BreakerThreshold dial failures in a row open a backend's circuit for
+	// BreakerCooldown (default 30s), then a single trial dial decides
+	// whether it closes again. Zero disables the breaker.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	Logger *slog.Logger
+
+	mu       sync.Mutex
+	backends []*backend
+	ring     []uint32
+	ringIdx  map[uint32]*backend
+	next     int
+}
+
+// NewBackendPool returns a pool over addrs, an empty strategy is RoundRobin.
+func NewBackendPool(addrs []string, strategy BalanceStrategy, logger *slog.Logger) (*BackendPool, error) {
+	switch strategy {
+	case "":
+		strategy = RoundRobin
+	case RoundRobin, LeastConns, ConsistentByKey:
+	default:
+		return nil, fmt.Errorf("unknown balance strategy %q", strategy)
+	}
+
+	pool := &BackendPool{
+		Strategy:         strategy,
+		Retries:          2,
+		BreakerThreshold: 5,
+		Logger:           logger,
+		ringIdx:          map[uint32]*backend{},
+	}
+	for _, addr := range addrs {
+		b := &backend{addr: addr, healthy: true}
+		pool.backends = append(pool.backends, b)
+		for i := 0; i < ringReplicas; i += 1 {
+			h := hashKey(addr + "#" + strconv.Itoa(i))
+			pool.ring = append(pool.ring, h)
+			pool.ringIdx[h] = b
+		}
+	}
+	sort.Slice(pool.ring, func(i, j int) bool { return pool.ring[i] < pool.ring[j] })
+	return pool, nil
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func (p *BackendPool) network() string {
+	if p.Network == "" {
+		return "tcp"
+	}
+	return p.Network
+}
+
+func (p *BackendPool) dialTimeout() time.Duration {
+	if p.DialTimeout == 0 {
+		return 5 * time.Second
+	}
+	return p.DialTimeout
+}
+
+func (p *BackendPool) healthTimeout() time.Duration {
+	if p.HealthTimeout == 0 {
+		return 2 * time.Second
+	}
+	return p.HealthTimeout
+}
+
+func (p *BackendPool) breakerCooldown() time.Duration {
+	if p.BreakerCooldown == 0 {
+		return 30 * time.Second
+	}
+	return p.BreakerCooldown
+}
+
+// order must be called with p.mu held, it returns every backend in the
+// order they should be tried.
+func (p *BackendPool) order(ctx ssh.Context) []*backend {
+	n := len(p.backends)
+	order := make([]*backend, 0, n)
+	switch p.Strategy {
+	case LeastConns:
+		order = append(order, p.backends...)
+		sort.SliceStable(order, func(i, j int) bool {
+			return order[i].conns < order[j].conns
+		})
+	case ConsistentByKey:
+		if len(p.ring) == 0 {
+			return order
+		}
+		// the certified key for certificates, so a reissued cert stays put
+		key := ""
+		if fingerprints := getKeyFingerprints(ctx); len(fingerprints) > 0 {
+			key = fingerprints[len(fingerprints)-1]
+		}
+		h := hashKey(key)
+		start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i] >= h })
+		seen := map[*backend]bool{}
+		for i := 0; i < len(p.ring) && len(order) < n; i += 1 {
+			b := p.ringIdx[p.ring[(start+i)%len(p.ring)]]
+			if !seen[b] {
+				seen[b] = true
+				order = append(order, b)
+			}
+		}
+	default:
+		for i := 0; i < n; i += 1 {
+			order = append(order, p.backends[(p.next+i)%n])
+		}
+		p.next += 1
+	}
+	return order
+}
+
+// available must be called with p.mu held.
+func (p *BackendPool) available(b *backend) bool {
+	if !b.healthy {
+		return false
+	}
+	if p.BreakerThreshold == 0 || b.dialFailures < p.BreakerThreshold {
+		return true
+	}
+	// half-open, let a single dial through
+	if time.Now().After(b.openUntil) && !b.trial {
+		b.trial = true
+		return true
+	}
+	return false
+}
+
+func (p *BackendPool) pick(ctx ssh.Context, tried map[*backend]bool) *backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, b := range p.order(ctx) {
+		if tried[b] || !p.available(b) {
+			continue
+		}
+		b.conns += 1
+		return b
+	}
+	return nil
+}
+
+func (p *BackendPool) dialed(b *backend, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b.trial = false
+	if err == nil {
+		b.dialFailures = 0
+		return
+	}
+
+	b.conns -= 1
+	b.dialFailures += 1
+	if p.BreakerThreshold > 0 && b.dialFailures >= p.BreakerThreshold {
+		b.openUntil = time.Now().Add(p.breakerCooldown())
+		p.Logger.Info(
+			"backend circuit open",
+			"backend", b.addr,
+			"dialFailures", b.dialFailures,
+			"until", b.openUntil,
+		)
+	}
+}
+
+func (p *BackendPool) release(b *backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b.conns -= 1
+}
+
+type poolConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *poolConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+func (c *poolConn) CloseWrite() error {
+	cw, ok := c.Conn.(closeWriter)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return cw.CloseWrite()
+}
+
+func (p *BackendPool) CreateConn(ctx ssh.Context) (net.Conn, error) {
+	tried := map[*backend]bool{}
+	var errs []error
+	for attempt := 0; attempt <= p.Retries; attempt += 1 {
+		b := p.pick(ctx, tried)
+		if b == nil {
+			break
+		}
+		tried[b] = true
+
+		conn, err := net.DialTimeout(p.network(), b.addr, p.dialTimeout())
+		p.dialed(b, err)
+		if err != nil {
+			p.Logger.Error(
+				"backend dial failed",
+				"backend", b.addr,
+				"attempt", attempt+1,
+				"user", ctx.User(),
+				"sessionID", ctx.SessionID(),
+				"err", err,
+			)
+			errs = append(errs, err)
+			continue
+		}
+
+		return &poolConn{
+			Conn:    conn,
+			release: func() { p.release(b) },
+		}, nil
+	}
+
+	if len(errs) == 0 {
+		return nil, ErrNoBackends
+	}
+	return nil, fmt.Errorf("%w: %w", ErrNoBackends, errors.Join(errs...))
+}
+
+func (p *BackendPool) GetLogger() *slog.Logger {
+	return p.Logger
+}
+
+func (p *BackendPool) Close(ctx ssh.Context) error {
+	return nil
+}
+
+func (p *BackendPool) check(addr string) error {
+	if p.HealthPath == "" {
+		conn, err := net.DialTimeout(p.network(), addr, p.healthTimeout())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	client := &http.Client{Timeout: p.healthTimeout()}
+	resp, err := client.Get(fmt.Sprintf("http://%s%s", addr, p.HealthPath))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (p *BackendPool) report(b *backend, err error) {
+	rise, fall := p.Rise, p.Fall
+	if rise == 0 {
+		rise = 2
+	}
+	if fall == 0 {
+		fall = 3
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		b.passes += 1
+		if !b.healthy && b.passes >= rise {
+			b.healthy = true
+			// a passing health check also closes the circuit
+			b.dialFailures = 0
+			p.Logger.Info("backend up", "backend", b.addr)
+		}
+		return
+	}
+
+	b.passes = 0
+	b.failures += 1
+	if b.healthy && b.failures >= fall {
+		b.healthy = false
+		p.Logger.Info("backend down", "backend", b.addr, "err", err)
+	}
+}
+
+// HealthCheck checks every backend once.
+func (p *BackendPool) HealthCheck() {
+	var wg sync.WaitGroup
+	for _, b := range p.backends {
+		wg.Add(1)
+		go func(b *backend) {
+			defer wg.Done()
+			p.report(b, p.check(b.addr))
+		}(b)
+	}
+	wg.Wait()
+}
+
+// Watch runs health checks every interval until ctx is done.
+func (p *BackendPool) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.HealthCheck()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *BackendPool) Stats() []BackendStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := make([]BackendStats, 0, len(p.backends))
+	for _, b := range p.backends {
+		stats = append(stats, BackendStats{
+			Addr:        b.addr,
+			Conns:       b.conns,
+			Healthy:     b.healthy,
+			BreakerOpen: p.BreakerThreshold > 0 && b.dialFailures >= p.BreakerThreshold,
+		})
+	}
+	return stats
+}
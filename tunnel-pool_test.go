@@ -0,0 +1,134 @@
+package tunkit
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestNewBackendPool(t *testing.T) {
+	tests := []struct {
+		strategy BalanceStrategy
+		want     BalanceStrategy
+		wantErr  bool
+	}{
+		{"", RoundRobin, false},
+		{RoundRobin, RoundRobin, false},
+		{LeastConns, LeastConns, false},
+		{ConsistentByKey, ConsistentByKey, false},
+		{"consistent-user", "", true},
+		{"least-connections", "", true},
+	}
+
+	for _, tt := range tests {
+		pool, err := NewBackendPool([]string{"a:1"}, tt.strategy, slog.Default())
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewBackendPool(%q) err = %v, wantErr %v", tt.strategy, err, tt.wantErr)
+			continue
+		}
+		if err == nil && pool.Strategy != tt.want {
+			t.Errorf("NewBackendPool(%q) strategy = %q, want %q", tt.strategy, pool.Strategy, tt.want)
+		}
+	}
+}
+
+func TestBackendPoolAvailable(t *testing.T) {
+	past := -time.Minute
+	future := time.Minute
+
+	tests := []struct {
+		name      string
+		threshold int
+		healthy   bool
+		failures  int
+		openFor   time.Duration
+		trial     bool
+		want      bool
+		wantTrial bool
+	}{
+		{"closed", 2, true, 0, 0, false, true, false},
+		{"below threshold", 2, true, 1, 0, false, true, false},
+		{"open", 2, true, 2, future, false, false, false},
+		{"half-open", 2, true, 2, past, false, true, true},
+		{"half-open trial in flight", 2, true, 2, past, true, false, true},
+		{"unhealthy", 2, false, 0, 0, false, false, false},
+		{"breaker disabled", 0, true, 10, future, false, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := &BackendPool{BreakerThreshold: tt.threshold}
+			b := &backend{
+				healthy:      tt.healthy,
+				dialFailures: tt.failures,
+				openUntil:    time.Now().Add(tt.openFor),
+				trial:        tt.trial,
+			}
+			if got := pool.available(b); got != tt.want {
+				t.Errorf("available() = %v, want %v", got, tt.want)
+			}
+			if b.trial != tt.wantTrial {
+				t.Errorf("trial = %v, want %v", b.trial, tt.wantTrial)
+			}
+		})
+	}
+}
+
+func TestBackendPoolBreaker(t *testing.T) {
+	errDial := errors.New("connection refused")
+
+	tests := []struct {
+		name     string
+		trial    error
+		wantOpen bool
+	}{
+		{"trial succeeds", nil, false},
+		{"trial fails", errDial, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool, err := NewBackendPool([]string{"a:1"}, RoundRobin, slog.Default())
+			if err != nil {
+				t.Fatal(err)
+			}
+			pool.BreakerThreshold = 2
+			pool.BreakerCooldown = time.Hour
+
+			for i := 0; i < pool.BreakerThreshold; i += 1 {
+				b := pool.pick(nil, map[*backend]bool{})
+				if b == nil {
+					t.Fatalf("pick() = nil after %d failures", i)
+				}
+				pool.dialed(b, errDial)
+			}
+			if b := pool.pick(nil, map[*backend]bool{}); b != nil {
+				t.Fatalf("pick() = %s while the circuit is open", b.addr)
+			}
+
+			// end the cooldown
+			b := pool.backends[0]
+			pool.mu.Lock()
+			b.openUntil = time.Now().Add(-time.Second)
+			pool.mu.Unlock()
+
+			trial := pool.pick(nil, map[*backend]bool{})
+			if trial == nil {
+				t.Fatal("pick() = nil when half-open")
+			}
+			if b := pool.pick(nil, map[*backend]bool{}); b != nil {
+				t.Fatal("pick() let a second dial through when half-open")
+			}
+			pool.dialed(trial, tt.trial)
+
+			stats := pool.Stats()
+			if stats[0].BreakerOpen != tt.wantOpen {
+				t.Errorf("BreakerOpen = %v, want %v", stats[0].BreakerOpen, tt.wantOpen)
+			}
+			if tt.wantOpen && !b.openUntil.After(time.Now()) {
+				t.Error("failed trial did not start a new cooldown")
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package tunkit
+
+import (
+	"net"
+
+	"github.com/charmbracelet/ssh"
+)
+
+type CreateConnFn = func(ctx ssh.Context) (net.Conn, error)
+
+// TunnelDecorator adds behavior around a tunnel's CreateConn, like a wish
+// middleware does around a session handler.
+type TunnelDecorator = func(next CreateConnFn) CreateConnFn
+
+type wrappedTunnel struct {
+	Tunnel
+	createConn CreateConnFn
+}
+
+func (wt *wrappedTunnel) CreateConn(ctx ssh.Context) (net.Conn, error) {
+	return wt.createConn(ctx)
+}
+
+// WrapTunnel composes decorators around t.CreateConn. Like
+// `wish.WithMiddleware`, the last decorator runs first.
+//
+//	faults := tunkit.NewFaultInjector(&tunkit.Faults{Latency: 200 * time.Millisecond})
+//	tunkit.WithTunnel(tunkit.WrapTunnel(handler, faults.Decorator()))
+func WrapTunnel(t Tunnel, decorators ...TunnelDecorator) Tunnel {
+	createConn := t.CreateConn
+	for _, decorator := range decorators {
+		createConn = decorator(createConn)
+	}
+	return &wrappedTunnel{
+		Tunnel:     t,
+		createConn: createConn,
+	}
+}
@@ -0,0 +1,61 @@
+package tunkit
+
+import (
+	"log/slog"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/charmbracelet/ssh"
+)
+
+// testTunnel hands out one end of a pipe per conn, the other end is kept
+// for the test.
+type testTunnel struct {
+	peers []net.Conn
+}
+
+func (tt *testTunnel) CreateConn(ctx ssh.Context) (net.Conn, error) {
+	client, server := halfPipe()
+	tt.peers = append(tt.peers, server)
+	return client, nil
+}
+
+func (tt *testTunnel) GetLogger() *slog.Logger {
+	return slog.Default()
+}
+
+func (tt *testTunnel) Close(ctx ssh.Context) error {
+	return nil
+}
+
+func TestWrapTunnelOrder(t *testing.T) {
+	calls := []string{}
+	decorator := func(name string) TunnelDecorator {
+		return func(next CreateConnFn) CreateConnFn {
+			return func(ctx ssh.Context) (net.Conn, error) {
+				calls = append(calls, name)
+				return next(ctx)
+			}
+		}
+	}
+
+	tunnel := &testTunnel{}
+	wrapped := WrapTunnel(tunnel, decorator("first"), decorator("second"), decorator("last"))
+	conn, err := wrapped.CreateConn(newTestContext(t, "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	want := []string{"last", "second", "first"}
+	if !slices.Equal(calls, want) {
+		t.Errorf("decorators ran in order %q, want %q", calls, want)
+	}
+	if len(tunnel.peers) != 1 {
+		t.Errorf("tunnel created %d conns, want 1", len(tunnel.peers))
+	}
+	if wrapped.GetLogger() != tunnel.GetLogger() {
+		t.Error("WrapTunnel did not keep the tunnel's logger")
+	}
+}
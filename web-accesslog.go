@@ -0,0 +1,205 @@
+package tunkit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+)
+
+type AccessLogFormat int
+
+const (
+	// AccessLogStructured only writes the slog record.
+	AccessLogStructured AccessLogFormat = iota
+	// AccessLogCommon additionally writes NCSA Common Log Format lines.
+	AccessLogCommon
+	// AccessLogCombined additionally writes NCSA Combined Log Format lines.
+	AccessLogCombined
+)
+
+var redacted = "[REDACTED]"
+
+// AccessLog writes one structured log record per request served through a
+// WebTunnel, tagged with the identity of the SSH connection. The upstream
+// latency is logged as timeToHeader: the time until the handler wrote the
+// response header.
+type AccessLog struct {
+	Logger *slog.Logger
+	// Headers are the request headers that are logged, all others are left
+	// out as they may carry credentials.
+	Headers []string
+	// RedactHeaders are logged when present but with their value replaced,
+	// whether or not they are in Headers.
+	RedactHeaders []string
+	Format        AccessLogFormat
+	// Writer receives Common/Combined Log Format lines.
+	Writer io.Writer
+}
+
+func NewAccessLog(logger *slog.Logger) *AccessLog {
+	return &AccessLog{
+		Logger: logger,
+		Headers: []string{
+			"Accept",
+			"Content-Length",
+			"Content-Type",
+			"User-Agent",
+			"X-Forwarded-For",
+			"X-Request-Id",
+		},
+		RedactHeaders: []string{
+			"Authorization",
+			"Cookie",
+			"Proxy-Authorization",
+		},
+	}
+}
+
+// accessLogWriter records what the handler wrote back to the client.
+type accessLogWriter struct {
+	http.ResponseWriter
+	start       time.Time
+	status      int
+	bytes       int64
+	firstHeader time.Duration
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.firstHeader = time.Since(w.start)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessLogWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (al *AccessLog) headers(r *http.Request) map[string]string {
+	headers := map[string]string{}
+	for _, name := range al.Headers {
+		values := r.Header.Values(name)
+		if len(values) > 0 {
+			headers[http.CanonicalHeaderKey(name)] = strings.Join(values, ", ")
+		}
+	}
+	for _, name := range al.RedactHeaders {
+		if len(r.Header.Values(name)) > 0 {
+			headers[http.CanonicalHeaderKey(name)] = redacted
+		}
+	}
+	return headers
+}
+
+// redactQuery keeps the names of query parameters but not their values,
+// which often carry tokens.
+func redactQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		name, _, _ := strings.Cut(param, "=")
+		params[i] = name + "=" + redacted
+	}
+	return "?" + strings.Join(params, "&")
+}
+
+// redactURL is rawURL with its query redacted.
+func redactURL(rawURL string) string {
+	base, query, ok := strings.Cut(rawURL, "?")
+	if !ok {
+		return rawURL
+	}
+	return base + redactQuery(query)
+}
+
+func (al *AccessLog) Handler(ctx ssh.Context, next http.Handler) http.Handler {
+	fingerprint := GetFingerprint(ctx)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lw := &accessLogWriter{ResponseWriter: w, start: time.Now()}
+		next.ServeHTTP(lw, r)
+		duration := time.Since(lw.start)
+		if lw.status == 0 {
+			// the handler returned without writing anything
+			lw.status = http.StatusOK
+			lw.firstHeader = duration
+		}
+
+		al.Logger.Info(
+			"access",
+			"user", ctx.User(),
+			"fingerprint", fingerprint,
+			"sessionID", ctx.SessionID(),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"proto", r.Proto,
+			"status", lw.status,
+			"bytes", lw.bytes,
+			"duration", duration,
+			"timeToHeader", lw.firstHeader,
+			"headers", al.headers(r),
+		)
+
+		if al.Writer == nil || al.Format == AccessLogStructured {
+			return
+		}
+
+		host, _, err := net.SplitHostPort(ctx.RemoteAddr().String())
+		if err != nil {
+			host = "-"
+		}
+		line := fmt.Sprintf(
+			"%s - %s [%s] %q %d %d",
+			host,
+			clfValue(ctx.User()),
+			lw.start.Format("02/Jan/2006:15:04:05 -0700"),
+			fmt.Sprintf("%s %s%s %s", r.Method, r.URL.EscapedPath(), redactQuery(r.URL.RawQuery), r.Proto),
+			lw.status,
+			lw.bytes,
+		)
+		if al.Format == AccessLogCombined {
+			line += fmt.Sprintf(" %q %q", clfValue(redactURL(r.Referer())), clfValue(r.UserAgent()))
+		}
+		_, err = fmt.Fprintln(al.Writer, line)
+		if err != nil {
+			al.Logger.Error("unable to write access log", "err", err)
+		}
+	})
+}
+
+func clfValue(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,102 @@
+package tunkit
+
+import (
+	"maps"
+	"net/http"
+	"testing"
+)
+
+func TestRedactURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"/", "/"},
+		{"/search?q=tunkit", "/search?q=[REDACTED]"},
+		{"/cb?code=abc&state=xyz", "/cb?code=[REDACTED]&state=[REDACTED]"},
+		{"/flag?debug", "/flag?debug=[REDACTED]"},
+		{"https://example.com/?token=secret#top", "https://example.com/?token=[REDACTED]"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := redactURL(tt.url); got != tt.want {
+			t.Errorf("redactURL(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestAccessLogHeaders(t *testing.T) {
+	request := http.Header{
+		"Accept":        {"application/json"},
+		"Authorization": {"Bearer secret"},
+		"Cookie":        {"session=secret"},
+		"X-Api-Key":     {"secret"},
+		"X-Request-Id":  {"abc", "def"},
+	}
+
+	tests := []struct {
+		name    string
+		headers []string
+		redact  []string
+		want    map[string]string
+	}{
+		{
+			name:    "allowlist",
+			headers: []string{"Accept", "x-request-id", "User-Agent"},
+			want: map[string]string{
+				"Accept":       "application/json",
+				"X-Request-Id": "abc, def",
+			},
+		},
+		{
+			name:   "redacted only",
+			redact: []string{"authorization", "X-Api-Key", "Proxy-Authorization"},
+			want: map[string]string{
+				"Authorization": "[REDACTED]",
+				"X-Api-Key":     "[REDACTED]",
+			},
+		},
+		{
+			name:    "redaction wins",
+			headers: []string{"Accept", "Cookie"},
+			redact:  []string{"Cookie"},
+			want: map[string]string{
+				"Accept": "application/json",
+				"Cookie": "[REDACTED]",
+			},
+		},
+		{
+			name: "nothing configured",
+			want: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			al := &AccessLog{Headers: tt.headers, RedactHeaders: tt.redact}
+			r := &http.Request{Header: request}
+			got := al.headers(r)
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("headers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewAccessLogRedactsCredentials(t *testing.T) {
+	al := NewAccessLog(nil)
+	r := &http.Request{Header: http.Header{
+		"Authorization": {"Basic c2VjcmV0"},
+		"Cookie":        {"session=secret"},
+		"User-Agent":    {"curl/8.0"},
+	}}
+	want := map[string]string{
+		"Authorization": "[REDACTED]",
+		"Cookie":        "[REDACTED]",
+		"User-Agent":    "curl/8.0",
+	}
+	if got := al.headers(r); !maps.Equal(got, want) {
+		t.Errorf("headers() = %v, want %v", got, want)
+	}
+}
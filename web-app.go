@@ -0,0 +1,374 @@
+package tunkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+)
+
+// EnvSocket is the unix socket an app started by AppLauncher must listen on.
+var EnvSocket = "TUNKIT_SOCKET"
+
+// appProcess is one run of a user's app.
+type appProcess struct {
+	cmd    *exec.Cmd
+	dir    string
+	socket string
+	proxy  *httputil.ReverseProxy
+	// ready is closed once the app accepts connections or failed to,
+	// done once it exited.
+	ready chan struct{}
+	err   error
+	done  chan struct{}
+}
+
+func (p *appProcess) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// userApp is the app of one key. The identity and credential of the
+// connection that created it are kept for restarts, so later connections
+// with a different SSH user name cannot change who the app runs as.
+type userApp struct {
+	user     string
+	env      []string
+	cred     *ProcessCredential
+	sessions int
+	idle     *time.Timer
+	proc     *appProcess
+}
+
+// AppLauncher starts a long-running HTTP app per key on its first tunnel
+// and stops it IdleTimeout after the last SSH connection with that key ends.
+// For certificates the certified key counts, so renewed certificates share
+// the app. The app gets the identity of the connection that started it in
+// the TUNKIT_* environment variables and must listen on the unix socket in
+// TUNKIT_SOCKET. Serve it with NewAppTunnelHandler.
+type AppLauncher struct {
+	Command []string
+	Dir     string
+	// Env, Credential and Limits work like they do for ExecTunnelHandler.
+	Env        []string
+	Credential func(ctx ssh.Context) (*ProcessCredential, error)
+	Limits     *ProcessLimits
+	// SocketDir defaults to the system's temp dir.
+	SocketDir string
+	// StartTimeout defaults to 30s, IdleTimeout to 5m.
+	StartTimeout time.Duration
+	IdleTimeout  time.Duration
+	// StopTimeout is how long a stopped app has to exit after SIGTERM, for
+	// example to save its state, before it is killed. Defaults to 10s.
+	StopTimeout time.Duration
+	Logger      *slog.Logger
+
+	mu   sync.Mutex
+	apps map[string]*userApp
+}
+
+func NewAppLauncher(command []string, logger *slog.Logger) *AppLauncher {
+	return &AppLauncher{
+		Command: command,
+		Logger:  logger,
+		apps:    map[string]*userApp{},
+	}
+}
+
+// NewAppTunnelHandler serves every user's app through a WebTunnel.
+func NewAppTunnelHandler(launcher *AppLauncher, logger *slog.Logger) *WebTunnelHandler {
+	return NewWebTunnelHandlerErr(launcher.HttpHandler, logger)
+}
+
+func (l *AppLauncher) startTimeout() time.Duration {
+	if l.StartTimeout == 0 {
+		return 30 * time.Second
+	}
+	return l.StartTimeout
+}
+
+func (l *AppLauncher) idleTimeout() time.Duration {
+	if l.IdleTimeout == 0 {
+		return 5 * time.Minute
+	}
+	return l.IdleTimeout
+}
+
+func (l *AppLauncher) stopTimeout() time.Duration {
+	if l.StopTimeout == 0 {
+		return 10 * time.Second
+	}
+	return l.StopTimeout
+}
+
+// appKey returns whose app serves a connection.
+func appKey(ctx ssh.Context) (string, error) {
+	fingerprints := getKeyFingerprints(ctx)
+	if len(fingerprints) == 0 {
+		return "", fmt.Errorf("pubkey not set on `ssh.Context()` for connection")
+	}
+	return fingerprints[len(fingerprints)-1], nil
+}
+
+// start must be called with l.mu held.
+func (l *AppLauncher) start(app *userApp) (*appProcess, error) {
+	if len(l.Command) == 0 {
+		return nil, fmt.Errorf("no command configured")
+	}
+	cred := app.cred
+
+	dir, err := os.MkdirTemp(l.SocketDir, "tunkit-app-")
+	if err != nil {
+		return nil, err
+	}
+	if cred != nil {
+		// the app creates its socket in here
+		err = os.Chown(dir, int(cred.Uid), int(cred.Gid))
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+	socket := filepath.Join(dir, "app.sock")
+
+	cmd := exec.Command(l.Command[0], l.Command[1:]...)
+	cmd.Dir = l.Dir
+	cmd.Env = processEnv(l.Env, cred)
+	cmd.Env = append(cmd.Env, app.env...)
+	cmd.Env = append(cmd.Env, EnvSocket+"="+socket)
+	log := l.Logger.With(
+		"cmd", l.Command[0],
+		"user", app.user,
+	)
+	output := &logWriter{log: log}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.WaitDelay = time.Second
+	err = setProcessAttrs(cmd, cred)
+	if err == nil {
+		err = startProcess(cmd, l.Limits)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	proc := &appProcess{
+		cmd:    cmd,
+		dir:    dir,
+		socket: socket,
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	proc.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(&url.URL{Scheme: "http", Host: "app"})
+			r.Out.Host = r.In.Host
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	log = log.With("pid", cmd.Process.Pid)
+	log.Info("app started", "socket", socket)
+
+	go func() {
+		err := cmd.Wait()
+		output.Flush()
+		close(proc.done)
+		os.RemoveAll(dir)
+		log.Info("app exited", "err", err)
+	}()
+	go l.waitReady(proc, log)
+
+	return proc, nil
+}
+
+func (l *AppLauncher) waitReady(proc *appProcess, log *slog.Logger) {
+	defer close(proc.ready)
+	timeout := time.After(l.startTimeout())
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		conn, err := net.Dial("unix", proc.socket)
+		if err == nil {
+			conn.Close()
+			log.Info("app ready")
+			return
+		}
+
+		select {
+		case <-proc.done:
+			proc.err = errors.New("app exited before listening")
+			return
+		case <-timeout:
+			proc.err = fmt.Errorf("app did not listen on %s within %s", proc.socket, l.startTimeout())
+			log.Error("app start timeout", "err", proc.err)
+			killProcess(proc.cmd)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// process returns the running app, starting it when needed.
+func (l *AppLauncher) process(app *userApp) (*appProcess, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if app.proc == nil || app.proc.exited() {
+		proc, err := l.start(app)
+		if err != nil {
+			return nil, err
+		}
+		app.proc = proc
+	}
+	return app.proc, nil
+}
+
+func (l *AppLauncher) release(key string, app *userApp) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	app.sessions -= 1
+	if app.sessions > 0 {
+		return
+	}
+	app.idle = time.AfterFunc(l.idleTimeout(), func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if app.sessions > 0 || l.apps[key] != app {
+			return
+		}
+		delete(l.apps, key)
+		l.stop(app)
+	})
+}
+
+// stop asks the app to exit and kills it after StopTimeout, the returned
+// channel is closed once it exited. stop must be called with l.mu held.
+func (l *AppLauncher) stop(app *userApp) <-chan struct{} {
+	if app.idle != nil {
+		app.idle.Stop()
+	}
+	proc := app.proc
+	if proc == nil {
+		return nil
+	}
+	if !proc.exited() {
+		log := l.Logger.With("user", app.user, "pid", proc.cmd.Process.Pid)
+		log.Info("stopping app")
+		terminateProcess(proc.cmd)
+		go func() {
+			select {
+			case <-proc.done:
+			case <-time.After(l.stopTimeout()):
+				log.Info("app did not stop, killing it", "timeout", l.stopTimeout())
+				killProcess(proc.cmd)
+			}
+		}()
+	}
+	return proc.done
+}
+
+// HttpHandler is a HttpHandlerErrFn that proxies to the key's app and
+// keeps it running while the SSH connection is open.
+func (l *AppLauncher) HttpHandler(ctx ssh.Context) (http.Handler, error) {
+	key, err := appKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var cred *ProcessCredential
+	if l.Credential != nil {
+		cred, err = l.Credential(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l.mu.Lock()
+	if l.apps == nil {
+		l.apps = map[string]*userApp{}
+	}
+	app, ok := l.apps[key]
+	if !ok {
+		app = &userApp{
+			user: ctx.User(),
+			env:  identityEnv(ctx),
+			cred: cred,
+		}
+		l.apps[key] = app
+	}
+	app.sessions += 1
+	if app.idle != nil {
+		app.idle.Stop()
+		app.idle = nil
+	}
+	l.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		l.release(key, app)
+	}()
+
+	// start right away so the app is warm for the first request
+	_, err = l.process(app)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proc, err := l.process(app)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		// hold the request while the app starts up
+		select {
+		case <-proc.ready:
+		case <-r.Context().Done():
+			return
+		}
+		if proc.err != nil {
+			http.Error(w, proc.err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		proc.proxy.ServeHTTP(w, r)
+	}), nil
+}
+
+// Shutdown stops every app and waits for them to exit.
+func (l *AppLauncher) Shutdown() {
+	l.mu.Lock()
+	stopped := []<-chan struct{}{}
+	for key, app := range l.apps {
+		if done := l.stop(app); done != nil {
+			stopped = append(stopped, done)
+		}
+		delete(l.apps, key)
+	}
+	l.mu.Unlock()
+
+	for _, done := range stopped {
+		<-done
+	}
+}
@@ -0,0 +1,119 @@
+package tunkit
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+)
+
+// appContext returns a connection of key that ends with cancel.
+func appContext(t *testing.T, key ssh.PublicKey) (*testContext, context.CancelFunc) {
+	t.Helper()
+	ctx := newTestContext(t, "alice")
+	ctx.SetValue(ssh.ContextKeyPublicKey, key)
+	connCtx, cancel := context.WithCancel(ctx.Context)
+	ctx.Context = connCtx
+	return ctx, cancel
+}
+
+func launchedApp(l *AppLauncher) *appProcess {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, app := range l.apps {
+		return app.proc
+	}
+	return nil
+}
+
+func waitExit(t *testing.T, proc *appProcess, within time.Duration) {
+	t.Helper()
+	select {
+	case <-proc.done:
+	case <-time.After(within):
+		t.Fatalf("app still running after %s", within)
+	}
+}
+
+func TestAppLauncherIdleStop(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("needs sh")
+	}
+	key := newTestSigner(t).PublicKey()
+	l := NewAppLauncher([]string{"sh", "-c", "while :; do sleep 0.1; done"}, slog.Default())
+	l.IdleTimeout = 100 * time.Millisecond
+	t.Cleanup(l.Shutdown)
+
+	first, endFirst := appContext(t, key)
+	second, endSecond := appContext(t, key)
+	for _, ctx := range []ssh.Context{first, second} {
+		_, err := l.HttpHandler(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	proc := launchedApp(l)
+	if proc == nil {
+		t.Fatal("no app started")
+	}
+
+	// the second connection keeps the app running
+	endFirst()
+	time.Sleep(3 * l.IdleTimeout)
+	if proc.exited() || launchedApp(l) != proc {
+		t.Fatal("app stopped while a connection was open")
+	}
+
+	endSecond()
+	waitExit(t, proc, 5*time.Second)
+	if launchedApp(l) != nil {
+		t.Error("stopped app is still registered")
+	}
+}
+
+func TestAppLauncherStopGrace(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("needs sh")
+	}
+
+	tests := []struct {
+		name       string
+		script     string
+		wantSaved  bool
+		stopWithin time.Duration
+	}{
+		{"exits on sigterm", `trap 'touch "$SAVED"; exit 0' TERM; while :; do sleep 0.1; done`, true, 5 * time.Second},
+		{"ignores sigterm", `trap '' TERM; while :; do sleep 0.1; done`, false, 5 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := filepath.Join(t.TempDir(), "saved")
+			l := NewAppLauncher([]string{"sh", "-c", tt.script}, slog.Default())
+			l.Env = []string{"PATH=" + os.Getenv("PATH"), "SAVED=" + saved}
+			l.IdleTimeout = 10 * time.Millisecond
+			l.StopTimeout = 500 * time.Millisecond
+
+			ctx, end := appContext(t, newTestSigner(t).PublicKey())
+			_, err := l.HttpHandler(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			proc := launchedApp(l)
+			// let sh install its trap
+			time.Sleep(200 * time.Millisecond)
+			end()
+			waitExit(t, proc, tt.stopWithin)
+
+			_, err = os.Stat(saved)
+			if got := err == nil; got != tt.wantSaved {
+				t.Errorf("app saved its state = %v, want %v", got, tt.wantSaved)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package tunkit
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/charmbracelet/ssh"
+)
+
+// Authorization is the result of an Authorizer. When Response is set it is
+// served instead of the request, regardless of Allow.
+type Authorization struct {
+	Allow    bool
+	Response http.Handler
+}
+
+var (
+	AuthzAllow = Authorization{Allow: true}
+	AuthzDeny  = Authorization{Allow: false}
+)
+
+// AuthzRespond serves a custom response instead of the request.
+func AuthzRespond(response http.Handler) Authorization {
+	return Authorization{Response: response}
+}
+
+// Authorizer is called for every request served through a WebTunnel with
+// the SSH identity of the tunnel.
+type Authorizer interface {
+	Authorize(ctx ssh.Context, r *http.Request) Authorization
+}
+
+type AuthorizerFunc func(ctx ssh.Context, r *http.Request) Authorization
+
+func (fn AuthorizerFunc) Authorize(ctx ssh.Context, r *http.Request) Authorization {
+	return fn(ctx, r)
+}
+
+func authorizeHandler(ctx ssh.Context, authz Authorizer, logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := authz.Authorize(ctx, r)
+		if result.Response != nil {
+			result.Response.ServeHTTP(w, r)
+			return
+		}
+
+		if !result.Allow {
+			logger.Info(
+				"request denied",
+				"user", ctx.User(),
+				"fingerprint", GetFingerprint(ctx),
+				"method", r.Method,
+				"path", r.URL.Path,
+			)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,12 +1,16 @@
 package tunkit
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
 
 	"github.com/charmbracelet/ssh"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type ctxAddressKey struct{}
@@ -24,7 +28,28 @@ func setAddressCtx(ctx ssh.Context, address string) {
 
 type WebTunnelHandler struct {
 	HttpHandler HttpHandlerFn
-	Logger      *slog.Logger
+	// HttpHandlerErr is used instead of HttpHandler when set. An error (or
+	// panic) rejects the tunnel channel with the error as the reason.
+	HttpHandlerErr HttpHandlerErrFn
+	Logger         *slog.Logger
+	// TLSConfig, when set, serves the tunneled web service over https.
+	// See `CertAuthority.TLSConfig()` for locally-trusted certificates.
+	TLSConfig *tls.Config
+	// H2C enables cleartext HTTP/2 (prior knowledge and upgrade) which is
+	// required to serve gRPC without TLS.
+	H2C bool
+	// IdentityHeaders sets the Tunkit-* identity headers on every request,
+	// overwriting anything the client sent.
+	IdentityHeaders bool
+	// AccessLog, when set, logs every request with the SSH identity.
+	AccessLog *AccessLog
+	// Authorizer, when set, is asked to allow or deny every request.
+	Authorizer Authorizer
+	// Recorder, when set, captures traffic for the per-user inspector.
+	Recorder *Recorder
+	// RequestHistory keeps the last requests of every connection for
+	// `GetRecentRequests` and the dashboard.
+	RequestHistory bool
 }
 
 func NewWebTunnelHandler(handler HttpHandlerFn, logger *slog.Logger) *WebTunnelHandler {
@@ -34,12 +59,66 @@ func NewWebTunnelHandler(handler HttpHandlerFn, logger *slog.Logger) *WebTunnelH
 	}
 }
 
+func NewWebTunnelHandlerErr(handler HttpHandlerErrFn, logger *slog.Logger) *WebTunnelHandler {
+	return &WebTunnelHandler{
+		HttpHandlerErr: handler,
+		Logger:         logger,
+	}
+}
+
 func (wt *WebTunnelHandler) GetLogger() *slog.Logger {
 	return wt.Logger
 }
 
 func (wt *WebTunnelHandler) GetHttpHandler() HttpHandlerFn {
-	return wt.HttpHandler
+	return func(ctx ssh.Context) http.Handler {
+		handler, err := wt.CreateHttpHandler(ctx)
+		if err != nil {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			})
+		}
+		return handler
+	}
+}
+
+func (wt *WebTunnelHandler) CreateHttpHandler(ctx ssh.Context) (http.Handler, error) {
+	var handler http.Handler
+	if wt.HttpHandlerErr != nil {
+		var err error
+		handler, err = wt.HttpHandlerErr(ctx)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		handler = wt.HttpHandler(ctx)
+	}
+
+	// inside the authorization check so the inspector is only served to
+	// users allowed to reach its paths, replays are authorized again
+	if wt.Recorder != nil {
+		replay := handler
+		if wt.Authorizer != nil {
+			replay = authorizeHandler(ctx, wt.Authorizer, wt.GetLogger(), handler)
+		}
+		handler = wt.Recorder.handler(ctx, handler, replay)
+	}
+	if wt.Authorizer != nil {
+		handler = authorizeHandler(ctx, wt.Authorizer, wt.GetLogger(), handler)
+	}
+	if wt.IdentityHeaders {
+		handler = identityHeaders(ctx, handler)
+	}
+	if wt.AccessLog != nil {
+		handler = wt.AccessLog.Handler(ctx, handler)
+	}
+	if wt.RequestHistory {
+		handler = trackRequests(ctx, handler)
+	}
+	if wt.H2C {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	return handler, nil
 }
 
 func (wt *WebTunnelHandler) Close(ctx ssh.Context) error {
@@ -66,10 +145,14 @@ func (wt *WebTunnelHandler) CreateListener(ctx ssh.Context) (net.Listener, error
 	address := tempFile.Name()
 	os.Remove(address)
 
-	connListener, err := net.Listen("unix", address)
+	var connListener net.Listener
+	connListener, err = net.Listen("unix", address)
 	if err != nil {
 		return nil, err
 	}
+	if wt.TLSConfig != nil {
+		connListener = tls.NewListener(connListener, wt.TLSConfig)
+	}
 	setAddressCtx(ctx, address)
 	setListenerCtx(ctx, connListener)
 
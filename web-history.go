@@ -0,0 +1,72 @@
+package tunkit
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+)
+
+var requestHistory = 20
+
+// RequestSummary is a request recently served through a WebTunnel.
+type RequestSummary struct {
+	Time     time.Time
+	Method   string
+	Path     string
+	Status   int
+	Duration time.Duration
+}
+
+type requestLog struct {
+	sync.Mutex
+	requests []RequestSummary
+}
+
+type ctxRequestLogKey struct{}
+
+func getRequestLogCtx(ctx ssh.Context) *requestLog {
+	ctx.Lock()
+	defer ctx.Unlock()
+	rl, ok := ctx.Value(ctxRequestLogKey{}).(*requestLog)
+	if rl == nil || !ok {
+		rl = &requestLog{}
+		ctx.SetValue(ctxRequestLogKey{}, rl)
+	}
+	return rl
+}
+
+// GetRecentRequests returns the last requests served for the connection,
+// oldest first.
+func GetRecentRequests(ctx ssh.Context) []RequestSummary {
+	rl := getRequestLogCtx(ctx)
+	rl.Lock()
+	defer rl.Unlock()
+	return append([]RequestSummary{}, rl.requests...)
+}
+
+func trackRequests(ctx ssh.Context, next http.Handler) http.Handler {
+	rl := getRequestLogCtx(ctx)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lw := &accessLogWriter{ResponseWriter: w, start: time.Now()}
+		next.ServeHTTP(lw, r)
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+
+		rl.Lock()
+		defer rl.Unlock()
+		rl.requests = append(rl.requests, RequestSummary{
+			Time:     lw.start,
+			Method:   r.Method,
+			Path:     r.URL.Path,
+			Status:   lw.status,
+			Duration: time.Since(lw.start),
+		})
+		if len(rl.requests) > requestHistory {
+			rl.requests = rl.requests[len(rl.requests)-requestHistory:]
+		}
+	})
+}
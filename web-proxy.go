@@ -0,0 +1,297 @@
+package tunkit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+)
+
+// DestinationPolicy decides whether an identity may reach host:port through
+// a ForwardProxy.
+type DestinationPolicy interface {
+	AllowDestination(ctx ssh.Context, r *http.Request, hostport string) bool
+}
+
+type DestinationPolicyFunc func(ctx ssh.Context, r *http.Request, hostport string) bool
+
+func (fn DestinationPolicyFunc) AllowDestination(ctx ssh.Context, r *http.Request, hostport string) bool {
+	return fn(ctx, r, hostport)
+}
+
+// matchDestination reports whether hostport matches one of the patterns
+// described at AllowDestinations.
+func matchDestination(patterns []string, hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, pattern := range patterns {
+		if _, cidr, err := net.ParseCIDR(pattern); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		patternHost, patternPort, err := net.SplitHostPort(pattern)
+		if err != nil {
+			patternHost, patternPort = pattern, ""
+		}
+		if patternPort != "" && patternPort != port {
+			continue
+		}
+		matched, err := path.Match(strings.ToLower(patternHost), host)
+		if err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowDestinations allows any destination matching one of the patterns,
+// whoever asks. A pattern is a host glob ("*.internal"), optionally with a
+// port ("registry:5000"), or a CIDR ("10.0.0.0/8") matched against IP
+// literals.
+func AllowDestinations(patterns ...string) DestinationPolicy {
+	return DestinationPolicyFunc(func(ctx ssh.Context, r *http.Request, hostport string) bool {
+		return matchDestination(patterns, hostport)
+	})
+}
+
+// IdentityDestinations allows every identity the destination patterns (see
+// AllowDestinations) listed for its SHA256 key fingerprint or its
+// certificate principals, which require WithUserCAs. Identities without an
+// entry reach nothing.
+type IdentityDestinations struct {
+	Keys       map[string][]string
+	Principals map[string][]string
+}
+
+func (id *IdentityDestinations) AllowDestination(ctx ssh.Context, r *http.Request, hostport string) bool {
+	for _, fp := range getKeyFingerprints(ctx) {
+		if matchDestination(id.Keys[fp], hostport) {
+			return true
+		}
+	}
+	for _, principal := range GetPrincipals(ctx) {
+		if matchDestination(id.Principals[principal], hostport) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForwardProxy turns a WebTunnel into an HTTP forward proxy: users point their
+// browser or CLI at the tunneled port and reach destinations allowed by
+// Policy using CONNECT or absolute-form requests.
+type ForwardProxy struct {
+	Policy      DestinationPolicy
+	Logger      *slog.Logger
+	DialTimeout time.Duration
+	// Dial overrides how upstream connections are made.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	once      sync.Once
+	transport *http.Transport
+}
+
+func NewForwardProxy(policy DestinationPolicy, logger *slog.Logger) *ForwardProxy {
+	return &ForwardProxy{
+		Policy:      policy,
+		Logger:      logger,
+		DialTimeout: 10 * time.Second,
+	}
+}
+
+func (fp *ForwardProxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if fp.Dial != nil {
+		return fp.Dial(ctx, network, addr)
+	}
+	dialer := &net.Dialer{Timeout: fp.DialTimeout}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+func (fp *ForwardProxy) getTransport() *http.Transport {
+	fp.once.Do(func() {
+		fp.transport = &http.Transport{
+			Proxy:                 nil,
+			DialContext:           fp.dial,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		}
+	})
+	return fp.transport
+}
+
+func destination(r *http.Request) (string, error) {
+	if r.Method == http.MethodConnect {
+		if _, _, err := net.SplitHostPort(r.Host); err != nil {
+			return "", fmt.Errorf("invalid CONNECT authority %q", r.Host)
+		}
+		return r.Host, nil
+	}
+
+	if !r.URL.IsAbs() || r.URL.Host == "" {
+		return "", fmt.Errorf("not a proxy request")
+	}
+	if r.URL.Port() != "" {
+		return r.URL.Host, nil
+	}
+	port := "80"
+	if r.URL.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(r.URL.Hostname(), port), nil
+}
+
+// HttpHandler is meant to be passed to `NewWebTunnelHandler`.
+func (fp *ForwardProxy) HttpHandler(ctx ssh.Context) http.Handler {
+	log := fp.Logger.With(
+		"user", ctx.User(),
+		"fingerprint", GetFingerprint(ctx),
+	)
+
+	proxy := &httputil.ReverseProxy{
+		Transport: fp.getTransport(),
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL = pr.In.URL
+			pr.Out.Host = pr.In.URL.Host
+			pr.Out.Header.Del("Proxy-Authorization")
+			pr.Out.Header.Del("Proxy-Connection")
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Error("proxy upstream error", "url", r.URL.String(), "err", err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dest, err := destination(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !fp.Policy.AllowDestination(ctx, r, dest) {
+			log.Info("proxy destination denied", "method", r.Method, "dest", dest)
+			http.Error(w, "destination not allowed", http.StatusForbidden)
+			return
+		}
+
+		log.Info("proxy request", "method", r.Method, "dest", dest)
+		if r.Method != http.MethodConnect {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+
+		fp.connect(w, r, dest, log)
+	})
+}
+
+func (fp *ForwardProxy) connect(w http.ResponseWriter, r *http.Request, dest string, log *slog.Logger) {
+	upConn, err := fp.dial(r.Context(), "tcp", dest)
+	if err != nil {
+		log.Error("proxy dial", "dest", dest, "err", err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer upConn.Close()
+
+	// HTTP/2 (h2c or TLS) carries the tunnel in the CONNECT stream itself,
+	// its conn cannot be hijacked
+	if r.ProtoMajor >= 2 {
+		fp.connectStream(w, r, upConn, log)
+		return
+	}
+
+	downConn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Error("proxy hijack", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer downConn.Close()
+
+	_, err = downConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		log.Error("proxy write", "err", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer upConn.Close()
+		// the client may have pipelined data after the CONNECT request
+		_, err := io.Copy(upConn, buf.Reader)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Error("io copy", "err", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer downConn.Close()
+		_, err := io.Copy(downConn, upConn)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Error("io copy", "err", err)
+		}
+	}()
+	wg.Wait()
+}
+
+// flushWriter flushes every write so tunneled bytes are not buffered.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (fw flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, fw.rc.Flush()
+}
+
+func (fp *ForwardProxy) connectStream(w http.ResponseWriter, r *http.Request, upConn net.Conn, log *slog.Logger) {
+	rc := http.NewResponseController(w)
+	w.WriteHeader(http.StatusOK)
+	err := rc.Flush()
+	if err != nil {
+		log.Error("proxy flush", "err", err)
+		return
+	}
+
+	go func() {
+		// fails once the stream is gone, which the copy below reports
+		_, _ = io.Copy(upConn, r.Body)
+		if cw, ok := upConn.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		}
+	}()
+
+	// the stream ends when the handler returns, which also stops the copy
+	// from the request body
+	_, err = io.Copy(flushWriter{w, rc}, upConn)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Error("io copy", "err", err)
+	}
+}
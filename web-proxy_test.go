@@ -0,0 +1,171 @@
+package tunkit
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestMatchDestination(t *testing.T) {
+	patterns := []string{"*.internal", "registry:5000", "10.0.0.0/8", "[::1]:8080"}
+
+	tests := []struct {
+		dest string
+		want bool
+	}{
+		{"db.internal:5432", true},
+		{"DB.Internal:5432", true},
+		{"internal:80", false},
+		{"a.b.internal:80", true},
+		{"db.internal.evil.com:80", false},
+		{"registry:5000", true},
+		{"registry:5001", false},
+		{"10.1.2.3:22", true},
+		{"11.0.0.1:22", false},
+		{"10.example.com:80", false},
+		{"[::1]:8080", true},
+		{"[::1]:8081", false},
+		{"db.internal", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchDestination(patterns, tt.dest); got != tt.want {
+			t.Errorf("matchDestination(%q) = %v, want %v", tt.dest, got, tt.want)
+		}
+	}
+}
+
+func TestIdentityDestinations(t *testing.T) {
+	alice := newTestSigner(t).PublicKey()
+	bob := newTestSigner(t).PublicKey()
+	policy := &IdentityDestinations{
+		Keys: map[string][]string{
+			gossh.FingerprintSHA256(alice): {"*.internal"},
+		},
+		Principals: map[string][]string{
+			"ops": {"10.0.0.0/8"},
+		},
+	}
+
+	ca := newTestSigner(t)
+	cert := &gossh.Certificate{
+		Key:             bob,
+		CertType:        gossh.UserCert,
+		ValidPrincipals: []string{"ops"},
+		ValidBefore:     gossh.CertTimeInfinity,
+	}
+	err := cert.SignCert(rand.Reader, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		key      gossh.PublicKey
+		verified bool
+		dest     string
+		want     bool
+	}{
+		{"own destination", alice, false, "db.internal:5432", true},
+		{"other destination", alice, false, "10.0.0.1:22", false},
+		{"unknown key", bob, false, "db.internal:5432", false},
+		{"no key", nil, false, "db.internal:5432", false},
+		{"principal", cert, true, "10.0.0.1:22", true},
+		{"unverified principal", cert, false, "10.0.0.1:22", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newTestContext(t, "alice")
+			if tt.key != nil {
+				ctx.SetValue(ssh.ContextKeyPublicKey, tt.key)
+			}
+			if tt.verified {
+				ctx.SetValue(ctxVerifiedCertKey{}, tt.key.Marshal())
+			}
+			if got := policy.AllowDestination(ctx, nil, tt.dest); got != tt.want {
+				t.Errorf("AllowDestination(%q) = %v, want %v", tt.dest, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardProxyConnectHTTP2(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		conn, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	ctx := newTestContext(t, "alice")
+	proxy := NewForwardProxy(AllowDestinations("127.0.0.1"), slog.Default())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: h2c.NewHandler(proxy.HttpHandler(ctx), &http2.Server{})}
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}
+	body, bodyWriter := io.Pipe()
+	req, err := http.NewRequest(http.MethodConnect, "http://"+ln.Addr().String(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = echo.Addr().String()
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+	}
+
+	_, err = bodyWriter.Write([]byte("PING\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		done <- line
+	}()
+	select {
+	case line := <-done:
+		if line != "PING\n" {
+			t.Errorf("echoed %q, want %q", line, "PING\n")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no data through the CONNECT stream")
+	}
+	_ = bodyWriter.Close()
+}
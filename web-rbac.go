@@ -0,0 +1,278 @@
+package tunkit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+// RBACRule allows any of Methods on any of Paths. "*" matches every method,
+// a trailing "/*" matches a path and everything below it and "{user}" only
+// matches the SSH user literally, glob characters in user names match
+// nothing but themselves.
+type RBACRule struct {
+	Methods []string `yaml:"methods"`
+	Paths   []string `yaml:"paths"`
+}
+
+// RBACBinding grants Role to any identity matching one of Users, Keys
+// (SHA256 fingerprints or authorized_keys lines) or certificate Principals.
+// Users are chosen by the client so they are rejected unless the policy sets
+// TrustUsers. Principals require WithUserCAs.
+type RBACBinding struct {
+	Role       string   `yaml:"role"`
+	Users      []string `yaml:"users"`
+	Keys       []string `yaml:"keys"`
+	Principals []string `yaml:"principals"`
+}
+
+// RBACPolicy is the YAML document loaded by RBACAuthorizer:
+//
+//	roles:
+//	  admin:
+//	    - methods: ["*"]
+//	      paths: ["/*"]
+//	  owner:
+//	    - methods: [GET, HEAD, PUT, PATCH, POST]
+//	      paths: ["/v2/{user}/*"]
+//	bindings:
+//	  - role: admin
+//	    principals: [ops]
+//	  - role: owner
+//	    keys: ["SHA256:..."]
+type RBACPolicy struct {
+	Roles    map[string][]RBACRule `yaml:"roles"`
+	Bindings []RBACBinding         `yaml:"bindings"`
+	// TrustUsers allows `users:` bindings. Only set it when authentication
+	// ties user names to keys, with `wish.WithAuthorizedKeys` any key
+	// holder can claim any user name.
+	TrustUsers bool `yaml:"trust_users"`
+}
+
+func ParseRBACPolicy(data []byte) (*RBACPolicy, error) {
+	policy := &RBACPolicy{}
+	err := yaml.Unmarshal(data, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, binding := range policy.Bindings {
+		if _, ok := policy.Roles[binding.Role]; !ok {
+			return nil, fmt.Errorf("binding %d references unknown role %q", i, binding.Role)
+		}
+		if len(binding.Users) > 0 && !policy.TrustUsers {
+			return nil, fmt.Errorf("binding %d uses users, which the client chooses, without trust_users", i)
+		}
+		err := normalizeKeys(binding.Keys)
+		if err != nil {
+			return nil, fmt.Errorf("binding %d has invalid key: %w", i, err)
+		}
+	}
+
+	return policy, nil
+}
+
+// normalizeKeys replaces authorized_keys lines with their SHA256
+// fingerprints.
+func normalizeKeys(keys []string) error {
+	for i, key := range keys {
+		if strings.HasPrefix(key, "SHA256:") {
+			continue
+		}
+		pubkey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			return err
+		}
+		keys[i] = gossh.FingerprintSHA256(pubkey)
+	}
+	return nil
+}
+
+// matchIdentity reports whether one of the user's key fingerprints or
+// CA-verified certificate principals is listed.
+func matchIdentity(ctx ssh.Context, keys []string, principals []string) bool {
+	for _, fp := range getKeyFingerprints(ctx) {
+		if slices.Contains(keys, fp) {
+			return true
+		}
+	}
+	for _, principal := range GetPrincipals(ctx) {
+		if slices.Contains(principals, principal) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RBACPolicy) roles(ctx ssh.Context) []string {
+	roles := []string{}
+	for _, binding := range p.Bindings {
+		trusted := p.TrustUsers && slices.Contains(binding.Users, ctx.User())
+		if trusted || matchIdentity(ctx, binding.Keys, binding.Principals) {
+			roles = append(roles, binding.Role)
+		}
+	}
+	return roles
+}
+
+// escapeGlob quotes the characters path.Match treats specially.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// matchPath matches urlPath segment by segment so a pattern never spans
+// segments and "{user}" is substituted as a literal.
+func matchPath(pattern, urlPath, user string) bool {
+	if pattern == "*" || pattern == "/*" {
+		return true
+	}
+	pattern, subtree := strings.CutSuffix(pattern, "/*")
+	patternSegs := strings.Split(pattern, "/")
+	pathSegs := strings.Split(urlPath, "/")
+	if len(pathSegs) < len(patternSegs) || (!subtree && len(pathSegs) != len(patternSegs)) {
+		return false
+	}
+
+	for i, seg := range patternSegs {
+		if strings.Contains(seg, "{user}") {
+			// a user name can never stand for several segments
+			if user == "" || strings.Contains(user, "/") {
+				return false
+			}
+			seg = strings.ReplaceAll(seg, "{user}", escapeGlob(user))
+		}
+		matched, err := path.Match(seg, pathSegs[i])
+		if err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (rule RBACRule) allows(ctx ssh.Context, r *http.Request) bool {
+	methodOk := slices.ContainsFunc(rule.Methods, func(method string) bool {
+		return method == "*" || strings.EqualFold(method, r.Method)
+	})
+	if !methodOk {
+		return false
+	}
+
+	urlPath := path.Clean("/" + r.URL.Path)
+	for _, pattern := range rule.Paths {
+		if matchPath(pattern, urlPath, ctx.User()) {
+			return true
+		}
+	}
+	return false
+}
+
+// RBACAuthorizer is a role-based Authorizer backed by a YAML policy file
+// that can be reloaded while the server is running.
+type RBACAuthorizer struct {
+	Path   string
+	Logger *slog.Logger
+
+	mu      sync.RWMutex
+	policy  *RBACPolicy
+	modTime time.Time
+}
+
+func NewRBACAuthorizer(policyPath string, logger *slog.Logger) (*RBACAuthorizer, error) {
+	authz := &RBACAuthorizer{
+		Path:   policyPath,
+		Logger: logger,
+	}
+	err := authz.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return authz, nil
+}
+
+// Reload reads the policy file again. On error the current policy is kept.
+func (a *RBACAuthorizer) Reload() error {
+	info, err := os.Stat(a.Path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(a.Path)
+	if err != nil {
+		return err
+	}
+	policy, err := ParseRBACPolicy(data)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.policy = policy
+	a.modTime = info.ModTime()
+	a.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the policy whenever the file changes until ctx is done.
+func (a *RBACAuthorizer) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(a.Path)
+			if err != nil {
+				a.Logger.Error("unable to stat rbac policy", "path", a.Path, "err", err)
+				continue
+			}
+
+			a.mu.RLock()
+			changed := !info.ModTime().Equal(a.modTime)
+			a.mu.RUnlock()
+			if !changed {
+				continue
+			}
+
+			err = a.Reload()
+			if err != nil {
+				a.Logger.Error("unable to reload rbac policy", "path", a.Path, "err", err)
+				continue
+			}
+			a.Logger.Info("reloaded rbac policy", "path", a.Path)
+		}
+	}
+}
+
+func (a *RBACAuthorizer) Authorize(ctx ssh.Context, r *http.Request) Authorization {
+	a.mu.RLock()
+	policy := a.policy
+	a.mu.RUnlock()
+
+	for _, role := range policy.roles(ctx) {
+		for _, rule := range policy.Roles[role] {
+			if rule.allows(ctx, r) {
+				return AuthzAllow
+			}
+		}
+	}
+	return AuthzDeny
+}
@@ -0,0 +1,122 @@
+package tunkit
+
+import (
+	"testing"
+)
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		path    string
+		user    string
+		want    bool
+	}{
+		{"everything", "/*", "/v2/alice/app", "alice", true},
+		{"star", "*", "/", "alice", true},
+		{"exact", "/v2/_catalog", "/v2/_catalog", "alice", true},
+		{"exact mismatch", "/v2/_catalog", "/v2/_catalog/x", "alice", false},
+		{"subtree root", "/v2/*", "/v2", "alice", true},
+		{"subtree child", "/v2/*", "/v2/alice/app/manifests/latest", "alice", true},
+		{"subtree sibling", "/v2/*", "/v20", "alice", false},
+		{"glob segment", "/v2/*/tags", "/v2/alice/tags", "alice", true},
+		{"glob does not span segments", "/v2/*/tags", "/v2/alice/app/tags", "alice", false},
+		{"own subtree", "/v2/{user}/*", "/v2/alice/app", "alice", true},
+		{"own root", "/v2/{user}/*", "/v2/alice", "alice", true},
+		{"other user", "/v2/{user}/*", "/v2/bob/app", "alice", false},
+		{"user prefix", "/v2/{user}/*", "/v2/alicex/app", "alice", false},
+		{"user in segment", "/v2/{user}-app", "/v2/alice-app", "alice", true},
+		{"star user", "/v2/{user}/*", "/v2/bob/app", "*", false},
+		{"star user own path", "/v2/{user}/*", "/v2/*/app", "*", true},
+		{"question user", "/v2/{user}/*", "/v2/b/app", "?", false},
+		{"bracket user", "/v2/{user}/*", "/v2/b/app", "[a-z]", false},
+		{"unterminated bracket user", "/v2/{user}/*", "/v2/bob/app", "[", false},
+		{"backslash user", "/v2/{user}/*", "/v2/b/app", `\b`, false},
+		{"slash user", "/v2/{user}/*", "/v2/a/b/app", "a/b", false},
+		{"dot dot user", "/v2/{user}/*", "/v2/b/app", "a/../b", false},
+		{"empty user", "/v2/{user}/*", "/v2/app", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := matchPath(tt.pattern, tt.path, tt.user)
+			if got != tt.want {
+				t.Errorf("matchPath(%q, %q, %q) = %v, want %v", tt.pattern, tt.path, tt.user, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRBACPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			policy: `
+roles:
+  owner:
+    - methods: ["*"]
+      paths: ["/v2/{user}/*"]
+bindings:
+  - role: owner
+    keys: ["SHA256:abc"]
+`,
+		},
+		{
+			name: "unknown role",
+			policy: `
+roles:
+  owner: []
+bindings:
+  - role: admin
+    keys: ["SHA256:abc"]
+`,
+			wantErr: true,
+		},
+		{
+			name: "users without trust_users",
+			policy: `
+roles:
+  owner: []
+bindings:
+  - role: owner
+    users: [alice]
+`,
+			wantErr: true,
+		},
+		{
+			name: "users with trust_users",
+			policy: `
+trust_users: true
+roles:
+  owner: []
+bindings:
+  - role: owner
+    users: [alice]
+`,
+		},
+		{
+			name: "invalid key",
+			policy: `
+roles:
+  owner: []
+bindings:
+  - role: owner
+    keys: ["not a key"]
+`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRBACPolicy([]byte(tt.policy))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseRBACPolicy() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
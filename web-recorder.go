@@ -0,0 +1,610 @@
+package tunkit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/charmbracelet/ssh"
+)
+
+// RecordedExchange is a request and response captured by a Recorder.
+type RecordedExchange struct {
+	ID                int
+	ReplayOf          int
+	Start             time.Time
+	Duration          time.Duration
+	Method            string
+	URL               string
+	Proto             string
+	RequestHeader     http.Header
+	RequestBody       []byte
+	RequestTruncated  bool
+	Status            int
+	ResponseHeader    http.Header
+	ResponseBody      []byte
+	ResponseTruncated bool
+}
+
+// DefaultRecorderLimit is the number of exchanges kept per identity when
+// Recorder.Limit is 0.
+var DefaultRecorderLimit = 100
+
+// RedactedHeaders are recorded as "[redacted]". Replays send the values of
+// the replaying request instead.
+var RedactedHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+}
+
+// Recorder keeps the last Limit exchanges per identity so users can inspect,
+// export (HAR) and replay the traffic going through their own tunnel at
+// Prefix, e.g. http://localhost:1338/_tunkit/inspect. An identity's
+// exchanges are dropped once its last SSH connection closes.
+type Recorder struct {
+	Limit       int
+	MaxBodySize int64
+	Prefix      string
+	// Hosts the inspector answers to, so pages of other sites cannot read
+	// it through DNS rebinding. Defaults to localhost, 127.0.0.1 and ::1
+	// with any port.
+	Hosts []string
+
+	mu        sync.Mutex
+	nextID    int
+	exchanges map[string][]*RecordedExchange
+	conns     map[string]int
+}
+
+func NewRecorder(limit int, maxBodySize int64) *Recorder {
+	return &Recorder{
+		Limit:       limit,
+		MaxBodySize: maxBodySize,
+		Prefix:      "/_tunkit/inspect",
+		exchanges:   map[string][]*RecordedExchange{},
+		conns:       map[string]int{},
+	}
+}
+
+func recorderKey(ctx ssh.Context) string {
+	fingerprint := GetFingerprint(ctx)
+	if fingerprint != "" {
+		return fingerprint
+	}
+	return "user:" + ctx.User()
+}
+
+// Exchanges returns the recorded exchanges for the identity, oldest first.
+func (rec *Recorder) Exchanges(ctx ssh.Context) []*RecordedExchange {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]*RecordedExchange{}, rec.exchanges[recorderKey(ctx)]...)
+}
+
+func (rec *Recorder) get(ctx ssh.Context, id int) *RecordedExchange {
+	for _, ex := range rec.Exchanges(ctx) {
+		if ex.ID == id {
+			return ex
+		}
+	}
+	return nil
+}
+
+func (rec *Recorder) add(ctx ssh.Context, ex *RecordedExchange) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.nextID += 1
+	ex.ID = rec.nextID
+
+	limit := rec.Limit
+	if limit <= 0 {
+		limit = DefaultRecorderLimit
+	}
+	key := recorderKey(ctx)
+	list := append(rec.exchanges[key], ex)
+	if len(list) > limit {
+		list = list[len(list)-limit:]
+	}
+	rec.exchanges[key] = list
+}
+
+// connected keeps the identity's exchanges until ctx is done and it has no
+// other connections.
+func (rec *Recorder) connected(ctx ssh.Context) {
+	key := recorderKey(ctx)
+	rec.mu.Lock()
+	if rec.exchanges == nil {
+		rec.exchanges = map[string][]*RecordedExchange{}
+	}
+	if rec.conns == nil {
+		rec.conns = map[string]int{}
+	}
+	rec.conns[key] += 1
+	rec.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		rec.conns[key] -= 1
+		if rec.conns[key] <= 0 {
+			delete(rec.conns, key)
+			delete(rec.exchanges, key)
+		}
+	}()
+}
+
+func redactHeader(header http.Header) http.Header {
+	header = header.Clone()
+	for _, name := range RedactedHeaders {
+		if _, ok := header[http.CanonicalHeaderKey(name)]; ok {
+			header.Set(name, "[redacted]")
+		}
+	}
+	return header
+}
+
+// recordedBody copies what the handler reads and notes when it read all.
+type recordedBody struct {
+	io.ReadCloser
+	buf *cappedBuffer
+	eof bool
+}
+
+func (b *recordedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	_, _ = b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// cappedBuffer keeps at most max bytes and remembers if it dropped any.
+type cappedBuffer struct {
+	bytes.Buffer
+	max       int64
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	room := b.max - int64(b.Len())
+	if int64(len(p)) > room {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+type recorderWriter struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   *cappedBuffer
+}
+
+func (w *recorderWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recorderWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	_, _ = w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recorderWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *recorderWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *recorderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// discardWriter is the client side of a replayed request.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardWriter) WriteHeader(int) {}
+
+func (rec *Recorder) record(ctx ssh.Context, next http.Handler, w http.ResponseWriter, r *http.Request, replayOf int) {
+	reqBody := &cappedBuffer{max: rec.MaxBodySize}
+	var body *recordedBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &recordedBody{ReadCloser: r.Body, buf: reqBody}
+		r.Body = body
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	ex := &RecordedExchange{
+		ReplayOf:      replayOf,
+		Start:         time.Now(),
+		Method:        r.Method,
+		URL:           scheme + "://" + r.Host + r.URL.RequestURI(),
+		Proto:         r.Proto,
+		RequestHeader: redactHeader(r.Header),
+	}
+	rw := &recorderWriter{
+		ResponseWriter: w,
+		body:           &cappedBuffer{max: rec.MaxBodySize},
+	}
+
+	next.ServeHTTP(rw, r)
+
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+		rw.header = w.Header().Clone()
+	}
+	ex.Duration = time.Since(ex.Start)
+	ex.RequestBody = reqBody.Bytes()
+	// a body the handler did not read to the end is incomplete as well
+	ex.RequestTruncated = reqBody.truncated || (body != nil && !body.eof)
+	ex.Status = rw.status
+	ex.ResponseHeader = redactHeader(rw.header)
+	ex.ResponseBody = rw.body.Bytes()
+	ex.ResponseTruncated = rw.body.truncated
+	rec.add(ctx, ex)
+}
+
+func (rec *Recorder) replay(ctx ssh.Context, next http.Handler, r *http.Request) error {
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		return err
+	}
+	ex := rec.get(ctx, id)
+	if ex == nil {
+		return errNotRecorded
+	}
+	if ex.RequestTruncated {
+		return errTruncatedReplay
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), ex.Method, ex.URL, bytes.NewReader(ex.RequestBody))
+	if err != nil {
+		return err
+	}
+	// server requests carry the request-target, not the absolute url
+	req.URL.Scheme = ""
+	req.URL.Host = ""
+	req.Header = ex.RequestHeader.Clone()
+	for _, name := range RedactedHeaders {
+		req.Header.Del(name)
+		for _, value := range r.Header.Values(name) {
+			req.Header.Add(name, value)
+		}
+	}
+	req.Host = r.Host
+	req.TLS = r.TLS
+	req.RemoteAddr = r.RemoteAddr
+	req.Proto = ex.Proto
+	req.RequestURI = req.URL.RequestURI()
+
+	rec.record(ctx, next, &discardWriter{header: http.Header{}}, req, ex.ID)
+	return nil
+}
+
+var (
+	errNotRecorded     = errors.New("exchange not found")
+	errTruncatedReplay = errors.New("request body was truncated and cannot be replayed")
+)
+
+// allowedHost reports if the inspector answers requests for host.
+func (rec *Recorder) allowedHost(host string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	hostname = strings.Trim(hostname, "[]")
+	hosts := rec.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+	}
+	for _, allowed := range hosts {
+		if strings.EqualFold(hostname, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler records the traffic to next and serves the inspector. Put it
+// behind any authorization, replays are sent to next directly.
+// WebTunnelHandler checks replays with its Authorizer again.
+func (rec *Recorder) Handler(ctx ssh.Context, next http.Handler) http.Handler {
+	return rec.handler(ctx, next, next)
+}
+
+// handler sends replays to replayNext so they are authorized against the
+// current policy rather than the one they were recorded under.
+func (rec *Recorder) handler(ctx ssh.Context, next http.Handler, replayNext http.Handler) http.Handler {
+	rec.connected(ctx)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, rec.Prefix) {
+			rec.record(ctx, next, w, r, 0)
+			return
+		}
+		if !rec.allowedHost(r.Host) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		switch strings.TrimPrefix(r.URL.Path, rec.Prefix) {
+		case "", "/":
+			rec.servePage(ctx, w)
+		case "/har":
+			har, err := rec.HAR(ctx)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Disposition", `attachment; filename="tunkit.har"`)
+			_, _ = w.Write(har)
+		case "/replay":
+			if r.Method != http.MethodPost {
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+			// other sites open in the browser must not trigger replays
+			origin, err := url.Parse(r.Header.Get("Origin"))
+			if err != nil || origin.Host == "" || origin.Host != r.Host {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			err = rec.replay(ctx, replayNext, r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Redirect(w, r, rec.Prefix, http.StatusSeeOther)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+var inspectorTmpl = template.Must(template.New("inspector").Funcs(template.FuncMap{
+	"body": func(b []byte) string {
+		if utf8.Valid(b) {
+			return string(b)
+		}
+		return base64.StdEncoding.EncodeToString(b)
+	},
+}).Parse(`<!doctype html>
+<html>
+<head><meta charset="utf-8"><title>tunkit inspector</title></head>
+<body>
+<h1>tunkit inspector: {{.User}}</h1>
+<p><a href="{{.Prefix}}/har">download HAR</a></p>
+{{range .Exchanges}}
+<details>
+<summary>#{{.ID}}{{if .ReplayOf}} (replay of #{{.ReplayOf}}){{end}} {{.Method}} {{.URL}} &rarr; {{.Status}} ({{.Duration}})</summary>
+<form method="post" action="{{$.Prefix}}/replay"><input type="hidden" name="id" value="{{.ID}}"><button>replay</button></form>
+<h3>request</h3>
+<pre>{{range $k, $v := .RequestHeader}}{{$k}}: {{range $v}}{{.}} {{end}}
+{{end}}
+{{body .RequestBody}}{{if .RequestTruncated}} [truncated]{{end}}</pre>
+<h3>response</h3>
+<pre>{{range $k, $v := .ResponseHeader}}{{$k}}: {{range $v}}{{.}} {{end}}
+{{end}}
+{{body .ResponseBody}}{{if .ResponseTruncated}} [truncated]{{end}}</pre>
+</details>
+{{else}}
+<p>no requests recorded yet</p>
+{{end}}
+</body>
+</html>`))
+
+func (rec *Recorder) servePage(ctx ssh.Context, w http.ResponseWriter) {
+	exchanges := rec.Exchanges(ctx)
+	// newest first
+	for i, j := 0, len(exchanges)-1; i < j; i, j = i+1, j-1 {
+		exchanges[i], exchanges[j] = exchanges[j], exchanges[i]
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := inspectorTmpl.Execute(w, map[string]any{
+		"User":      ctx.User(),
+		"Prefix":    rec.Prefix,
+		"Exchanges": exchanges,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	Cookies     []harNameValue `json:"cookies"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	Cookies     []harNameValue `json:"cookies"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harLog struct {
+	Log struct {
+		Version string `json:"version"`
+		Creator struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"creator"`
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	list := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			list = append(list, harNameValue{Name: name, Value: value})
+		}
+	}
+	return list
+}
+
+func harText(b []byte) (string, string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return base64.StdEncoding.EncodeToString(b), "base64"
+}
+
+// HAR exports the identity's recorded exchanges as a HAR 1.2 document.
+func (rec *Recorder) HAR(ctx ssh.Context) ([]byte, error) {
+	har := harLog{}
+	har.Log.Version = "1.2"
+	har.Log.Creator.Name = "tunkit"
+	har.Log.Creator.Version = "0"
+	har.Log.Entries = []harEntry{}
+
+	for _, ex := range rec.Exchanges(ctx) {
+		ms := float64(ex.Duration) / float64(time.Millisecond)
+		entry := harEntry{
+			StartedDateTime: ex.Start.Format(time.RFC3339Nano),
+			Time:            ms,
+			Timings:         harTimings{Wait: ms},
+		}
+		if ex.ReplayOf != 0 {
+			entry.Comment = "replay of #" + strconv.Itoa(ex.ReplayOf)
+		}
+
+		query := []harNameValue{}
+		if idx := strings.Index(ex.URL, "?"); idx >= 0 {
+			for _, pair := range strings.Split(ex.URL[idx+1:], "&") {
+				name, value, _ := strings.Cut(pair, "=")
+				query = append(query, harNameValue{Name: name, Value: value})
+			}
+		}
+		entry.Request = harRequest{
+			Method:      ex.Method,
+			URL:         ex.URL,
+			HTTPVersion: ex.Proto,
+			Headers:     harHeaders(ex.RequestHeader),
+			QueryString: query,
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(ex.RequestBody),
+		}
+		if len(ex.RequestBody) > 0 {
+			text, encoding := harText(ex.RequestBody)
+			entry.Request.PostData = &harPostData{
+				MimeType: ex.RequestHeader.Get("Content-Type"),
+				Text:     text,
+				Encoding: encoding,
+			}
+		}
+
+		text, encoding := harText(ex.ResponseBody)
+		entry.Response = harResponse{
+			Status:      ex.Status,
+			StatusText:  http.StatusText(ex.Status),
+			HTTPVersion: ex.Proto,
+			Headers:     harHeaders(ex.ResponseHeader),
+			Cookies:     []harNameValue{},
+			Content: harContent{
+				Size:     len(ex.ResponseBody),
+				MimeType: ex.ResponseHeader.Get("Content-Type"),
+				Text:     text,
+				Encoding: encoding,
+			},
+			RedirectURL: ex.ResponseHeader.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(ex.ResponseBody),
+		}
+		har.Log.Entries = append(har.Log.Entries, entry)
+	}
+
+	return json.MarshalIndent(har, "", "  ")
+}
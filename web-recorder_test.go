@@ -0,0 +1,67 @@
+package tunkit
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/charmbracelet/ssh"
+)
+
+func TestRecorderReplayIsAuthorized(t *testing.T) {
+	var deny atomic.Bool
+	handler := NewWebTunnelHandler(func(ctx ssh.Context) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("secret"))
+		})
+	}, slog.Default())
+	handler.Recorder = NewRecorder(10, 1024)
+	handler.Authorizer = AuthorizerFunc(func(ctx ssh.Context, r *http.Request) Authorization {
+		if deny.Load() && r.URL.Path == "/secret" {
+			return AuthzDeny
+		}
+		return AuthzAllow
+	})
+
+	ctx := newTestContext(t, "alice")
+	h, err := handler.CreateHttpHandler(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/secret", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("request status = %d, want 200", w.Code)
+	}
+
+	// the policy changes after the request was recorded
+	deny.Store(true)
+
+	exchanges := handler.Recorder.Exchanges(ctx)
+	if len(exchanges) != 1 {
+		t.Fatalf("recorded %d exchanges, want 1", len(exchanges))
+	}
+	form := url.Values{"id": {"1"}}
+	r := httptest.NewRequest(http.MethodPost, "http://localhost/_tunkit/inspect/replay", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Origin", "http://localhost")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("replay status = %d, want 303: %s", w.Code, w.Body)
+	}
+
+	exchanges = handler.Recorder.Exchanges(ctx)
+	replayed := exchanges[len(exchanges)-1]
+	if replayed.ReplayOf != 1 {
+		t.Fatalf("last exchange is not the replay: %+v", replayed)
+	}
+	if replayed.Status != http.StatusForbidden {
+		t.Errorf("replay status = %d, want %d", replayed.Status, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,292 @@
+package tunkit
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/ssh"
+	"github.com/charmbracelet/wish"
+)
+
+var (
+	caCertFile     = "ca.pem"
+	caKeyFile      = "ca-key.pem"
+	caValidity     = 10 * 365 * 24 * time.Hour
+	leafValidity   = 30 * 24 * time.Hour
+	leafRenewal    = 7 * 24 * time.Hour
+	defaultTLSHost = "localhost"
+)
+
+// CertAuthority is a tunkit-managed certificate authority that issues leaf
+// certificates on demand, keyed by the SNI hostname the client asks for.
+// Users download the CA certificate over SSH (see CAMiddleware) and add it
+// to their trust store so https://<app>.localhost:<port> is a secure context.
+type CertAuthority struct {
+	Cert    *x509.Certificate
+	CertPEM []byte
+	Key     crypto.Signer
+	// Hosts are the hostnames we are willing to issue certificates for.
+	// A leading "*." matches any subdomain.
+	Hosts []string
+
+	mu    sync.Mutex
+	cache map[string]*tls.Certificate
+}
+
+// NewCertAuthority loads the CA stored in dir or creates a new one when it
+// does not exist yet.
+func NewCertAuthority(dir string) (*CertAuthority, error) {
+	certPath := filepath.Join(dir, caCertFile)
+	keyPath := filepath.Join(dir, caKeyFile)
+
+	certPEM, err := os.ReadFile(certPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return createCertAuthority(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, fmt.Errorf("no certificate found in %s", certPath)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("no private key found in %s", keyPath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key in %s cannot sign", keyPath)
+	}
+
+	return newCertAuthority(cert, certPEM, signer), nil
+}
+
+func newCertAuthority(cert *x509.Certificate, certPEM []byte, key crypto.Signer) *CertAuthority {
+	return &CertAuthority{
+		Cert:    cert,
+		CertPEM: certPEM,
+		Key:     key,
+		Hosts:   []string{"localhost", "*.localhost"},
+		cache:   map[string]*tls.Certificate{},
+	}
+}
+
+func createCertAuthority(dir string) (*CertAuthority, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := randSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"tunkit"},
+			CommonName:   "tunkit local CA",
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		// keep the CA from being useful for anything but local names
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         []string{"localhost"},
+		PermittedIPRanges: []*net.IPNet{
+			{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+			{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+		},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+
+	err = os.WriteFile(filepath.Join(dir, caKeyFile), keyPEM, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(filepath.Join(dir, caCertFile), certPEM, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCertAuthority(cert, certPEM, key), nil
+}
+
+func randSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// AllowHost reports whether the CA is willing to issue a certificate for host.
+func (ca *CertAuthority) AllowHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range ca.Hosts {
+		pattern = strings.ToLower(pattern)
+		if pattern == host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok && strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCertificate satisfies `tls.Config.GetCertificate` and issues (or returns
+// a cached) leaf certificate for the requested SNI hostname.
+func (ca *CertAuthority) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if host == "" {
+		host = defaultTLSHost
+	}
+	if !ca.AllowHost(host) {
+		return nil, fmt.Errorf("refusing to issue certificate for %q", host)
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	cached := ca.cache[host]
+	if cached != nil && time.Until(cached.Leaf.NotAfter) > leafRenewal {
+		return cached, nil
+	}
+
+	cert, err := ca.issue(host)
+	if err != nil {
+		return nil, err
+	}
+	ca.cache[host] = cert
+	return cert, nil
+}
+
+func (ca *CertAuthority) issue(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := randSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"tunkit"},
+			CommonName:   host,
+		},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(leafValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:    []string{host},
+	}
+	if host == defaultTLSHost {
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, key.Public(), ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// TLSConfig returns a server config that issues certificates from this CA.
+func (ca *CertAuthority) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: ca.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+// CAMiddleware adds a `ca` session command that prints the CA certificate so
+// users can add it to their trust store:
+//
+//	ssh -p 2222 localhost ca > tunkit-ca.pem
+func CAMiddleware(ca *CertAuthority) wish.Middleware {
+	return func(next ssh.Handler) ssh.Handler {
+		return func(sesh ssh.Session) {
+			args := sesh.Command()
+			if len(args) == 0 || strings.TrimSpace(args[0]) != "ca" {
+				next(sesh)
+				return
+			}
+
+			_, err := sesh.Write(ca.CertPEM)
+			if err != nil {
+				wish.Fatalln(sesh, err)
+				return
+			}
+			wish.Errorln(sesh, "save this certificate and add it to your system or browser trust store")
+		}
+	}
+}
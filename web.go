@@ -1,6 +1,8 @@
 package tunkit
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
@@ -10,6 +12,7 @@ import (
 )
 
 type HttpHandlerFn = func(ctx ssh.Context) http.Handler
+type HttpHandlerErrFn = func(ctx ssh.Context) (http.Handler, error)
 
 type WebTunnel interface {
 	GetHttpHandler() HttpHandlerFn
@@ -19,10 +22,31 @@ type WebTunnel interface {
 	Close(ctx ssh.Context) error
 }
 
+// WebTunnelErr is implemented by web tunnels whose http handler can fail to
+// build, in which case the channel is rejected instead of served.
+type WebTunnelErr interface {
+	WebTunnel
+	CreateHttpHandler(ctx ssh.Context) (http.Handler, error)
+}
+
 func WithWebTunnel(handler WebTunnel) ssh.Option {
 	return WithTunnel(handler)
 }
 
+func createHttpHandler(handler WebTunnel, ctx ssh.Context) (httpHandler http.Handler, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("http handler panic: %v", r)
+		}
+	}()
+
+	if creator, ok := handler.(WebTunnelErr); ok {
+		return creator.CreateHttpHandler(ctx)
+	}
+	httpHandlerFn := handler.GetHttpHandler()
+	return httpHandlerFn(ctx), nil
+}
+
 type ctxListenerKey struct{}
 
 func getListenerCtx(ctx ssh.Context) (net.Listener, error) {
@@ -42,6 +66,11 @@ func httpServe(handler WebTunnel, ctx ssh.Context, log *slog.Logger) (net.Listen
 		return cached, nil
 	}
 
+	httpHandler, err := createHttpHandler(handler, ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	listener, err := handler.CreateListener(ctx)
 	if err != nil {
 		return nil, err
@@ -49,10 +78,18 @@ func httpServe(handler WebTunnel, ctx ssh.Context, log *slog.Logger) (net.Listen
 	setListenerCtx(ctx, listener)
 
 	go func() {
-		httpHandler := handler.GetHttpHandler()
-		err := http.Serve(listener, httpHandler(ctx))
+		srv := &http.Server{
+			Handler: httpHandler,
+			BaseContext: func(net.Listener) context.Context {
+				return withSshCtx(ctx, ctx)
+			},
+		}
+		err := srv.Serve(listener)
 		if err != nil {
 			log.Error("serving http content", "err", err)
+			if !errors.Is(err, net.ErrClosed) {
+				Notify(ctx, slog.LevelError, "web tunnel stopped serving", err)
+			}
 		}
 	}()
 
@@ -0,0 +1,154 @@
+package tunkit
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+type wsAddr string
+
+func (a wsAddr) Network() string { return "websocket" }
+func (a wsAddr) String() string  { return string(a) }
+
+// wsConn is an SSH connection carried in binary websocket frames.
+type wsConn struct {
+	*websocket.Conn
+	remoteAddr net.Addr
+	once       sync.Once
+	done       chan struct{}
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *wsConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	return c.Conn.Close()
+}
+
+// WebSocketListener accepts SSH connections carried inside websocket frames
+// for users that can only get out over HTTP(S). Mount it on an http server
+// and pass it to the ssh server:
+//
+//	ws := tunkit.NewWebSocketListener(logger)
+//	http.Handle("/ssh", ws)
+//	go s.Serve(ws)
+//
+// Clients connect with DialWebSocket.
+type WebSocketListener struct {
+	Logger *slog.Logger
+
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func NewWebSocketListener(logger *slog.Logger) *WebSocketListener {
+	return &WebSocketListener{
+		Logger: logger,
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+}
+
+func (wl *WebSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-wl.conns:
+		return conn, nil
+	case <-wl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (wl *WebSocketListener) Close() error {
+	wl.once.Do(func() {
+		close(wl.done)
+	})
+	return nil
+}
+
+func (wl *WebSocketListener) Addr() net.Addr {
+	return wsAddr("websocket")
+}
+
+func (wl *WebSocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server := websocket.Server{
+		// ssh authenticates the connection, the origin does not matter
+		Handshake: func(*websocket.Config, *http.Request) error {
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+
+			var remoteAddr net.Addr = wsAddr(r.RemoteAddr)
+			addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+			if err == nil {
+				remoteAddr = addr
+			}
+
+			conn := &wsConn{
+				Conn:       ws,
+				remoteAddr: remoteAddr,
+				done:       make(chan struct{}),
+			}
+			wl.Logger.Info("websocket connection", "remoteAddr", r.RemoteAddr)
+
+			select {
+			case wl.conns <- conn:
+			case <-wl.done:
+				return
+			case <-r.Context().Done():
+				return
+			}
+
+			// the websocket is closed when the handler returns
+			select {
+			case <-conn.done:
+			case <-wl.done:
+			}
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+// DialWebSocket connects to a WebSocketListener at rawURL (ws:// or wss://)
+// and returns a conn to run the SSH client over, e.g. with
+// `gossh.NewClientConn` or as a ProxyCommand.
+func DialWebSocket(rawURL string, tlsConfig *tls.Config) (net.Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	origin := &url.URL{Scheme: "http", Host: u.Host}
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		origin.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme %q", u.Scheme)
+	}
+
+	config, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	config.TlsConfig = tlsConfig
+
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}